@@ -5,18 +5,28 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/harold/proxy-harold/internal/auth"
 	"github.com/harold/proxy-harold/internal/cache"
+	"github.com/harold/proxy-harold/internal/cors"
 	"github.com/harold/proxy-harold/internal/handler"
+	"github.com/harold/proxy-harold/internal/metrics"
 	"github.com/harold/proxy-harold/internal/proxy"
 	"github.com/harold/proxy-harold/internal/ratelimit"
+	"github.com/harold/proxy-harold/internal/signing"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign" {
+		os.Exit(runSign(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	// Configure logging
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
@@ -25,10 +35,48 @@ func main() {
 	port := getEnv("PORT", "8888")
 	cacheTTL := getEnvDuration("CACHE_TTL", 1*time.Hour)
 	cacheDir := getEnv("CACHE_DIR", "./cache_data")
+	cacheMemorySize := getEnvInt64("CACHE_MEMORY_SIZE", 64*1024*1024) // 64MB
+	cacheCompression := getEnvBool("CACHE_COMPRESSION", true)
+	cacheMaxSize := getEnvInt64("CACHE_MAX_SIZE", 0) // unlimited
+	cacheEvictionPolicy := getEnv("CACHE_EVICTION_POLICY", string(cache.EvictLRU))
+	cacheGCInterval := getEnvDuration("CACHE_GC_INTERVAL", 5*time.Minute)
+	cacheMaxVariants := getEnvInt("CACHE_MAX_VARIANTS", cache.DefaultMaxVariants)
+	revalidateWindow := getEnvDuration("CACHE_REVALIDATE_WINDOW", 24*time.Hour)
+	staleWhileRevalidate := getEnvDuration("CACHE_STALE_WHILE_REVALIDATE", 0)
+	staleIfError := getEnvDuration("CACHE_STALE_IF_ERROR", 0)
+	cacheKeyStripParams := getEnvList("CACHE_KEY_STRIP_PARAMS", cache.DefaultStripParams)
 	rateLimit := getEnvFloat("RATE_LIMIT", 100) // requests per second
 	rateBurst := getEnvInt("RATE_BURST", 200)   // burst size
 	fetchTimeout := getEnvDuration("FETCH_TIMEOUT", 30*time.Second)
-	maxResponseSize := getEnvInt64("MAX_RESPONSE_SIZE", 10*1024*1024) // 10MB
+	maxResponseSize := getEnvInt64("MAX_RESPONSE_SIZE", 10*1024*1024)     // 10MB
+	maxCacheEntrySize := getEnvInt64("CACHE_MAX_ENTRY_SIZE", 5*1024*1024) // 5MB
+	maxRequestBody := getEnvInt64("MAX_REQUEST_BODY", 1024*1024)          // 1MB
+	compression := getEnvBool("COMPRESSION", true)
+	compressionLevel := getEnvInt("COMPRESSION_LEVEL", 0) // encoder defaults
+	compressionMinSize := getEnvInt64("COMPRESSION_MIN_SIZE", handler.DefaultCompressionMinSize)
+	upstreamEncoding := getEnvBool("UPSTREAM_ENCODING", false)
+	maxDecodedSize := getEnvInt64("MAX_DECODED_SIZE", handler.DefaultMaxDecodedSize) // 100MB
+	destAllowCIDRs := getEnvList("DEST_ALLOW_CIDRS", nil)
+	destDenyCIDRs := getEnvList("DEST_DENY_CIDRS", nil)
+	hostRulesFile := getEnv("HOST_RULES_FILE", "")
+	hostDefaultPolicy := getEnv("HOST_DEFAULT_POLICY", proxy.ActionAllow)
+	secretsFile := getEnv("SECRETS_FILE", "")
+	requestHeadersAllow := getEnvList("REQUEST_HEADERS_ALLOW", proxy.DefaultRequestHeaders)
+	requestHeadersDeny := getEnvList("REQUEST_HEADERS_DENY", nil)
+	responseHeadersAllow := getEnvList("RESPONSE_HEADERS_ALLOW", proxy.DefaultResponseHeaders)
+	responseHeadersDeny := getEnvList("RESPONSE_HEADERS_DENY", nil)
+	forwardCookies := getEnvBool("FORWARD_COOKIES", false)
+	cacheableStatuses := getEnvIntList("CACHEABLE_STATUSES", handler.DefaultCacheableStatuses)
+	negativeTTL := getEnvDuration("NEGATIVE_CACHE_TTL", 5*time.Minute)
+	negativeTTLs := getEnvDurationMap("NEGATIVE_CACHE_TTLS")
+	corsOrigins := getEnvList("CORS_ALLOWED_ORIGINS", nil) // no browser origins
+	corsCredentials := getEnvBool("CORS_ALLOW_CREDENTIALS", false)
+	adminToken := getEnv("ADMIN_TOKEN", "")
+	apiKeysFile := getEnv("API_KEYS_FILE", "")
+	apiKeysDir := getEnv("API_KEYS_DIR", "")
+	signingSecrets := getEnvList("SIGNING_SECRETS", nil)
+	signedURLsRequired := getEnvBool("SIGNED_URLS_REQUIRED", false)
+	metricsUpstreamHosts := getEnvInt("METRICS_UPSTREAM_HOSTS", 0) // host rules only
 
 	log.Info().
 		Str("port", port).
@@ -39,35 +87,159 @@ func main() {
 		Msg("Starting proxy server")
 
 	// Initialize cache
-	badgerCache, err := cache.NewBadgerCache(cacheDir, cacheTTL)
+	evictionPolicy, err := cache.ParseEvictionPolicy(cacheEvictionPolicy)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid CACHE_EVICTION_POLICY")
+	}
+	badgerCache, err := cache.NewBadgerCache(cacheDir, cacheTTL,
+		cache.WithRevalidationWindow(revalidateWindow),
+		cache.WithCompression(cacheCompression),
+		cache.WithMaxSize(cacheMaxSize, evictionPolicy),
+		cache.WithMaintenanceInterval(cacheGCInterval),
+		cache.WithMaxVariants(cacheMaxVariants),
+	)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize cache")
 	}
 	defer badgerCache.Close()
+	tieredCache := cache.NewTieredCache(badgerCache, cacheMemorySize)
 
-	// Initialize rate limiter
-	limiter := ratelimit.NewIPRateLimiter(rateLimit, rateBurst)
-	defer limiter.Cleanup()
+	// Initialize metrics
+	m := metrics.New(metrics.WithUpstreamHosts(metricsUpstreamHosts))
+	m.WatchCache(badgerCache.Stats)
+	m.WatchTiers(tieredCache.TierStats)
 
-	// Initialize fetcher
-	fetcher := proxy.NewFetcher(fetchTimeout, maxResponseSize)
+	// Initialize CORS origin policy
+	corsPolicy, err := cors.NewPolicy(corsOrigins, corsCredentials)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid CORS origin configuration")
+	}
+	if len(corsOrigins) == 0 {
+		log.Warn().Msg("CORS_ALLOWED_ORIGINS is empty, requests from web pages will be rejected")
+	}
+
+	// Initialize API keys, if configured
+	var keyStore auth.Store
+	switch {
+	case apiKeysFile != "" && apiKeysDir != "":
+		log.Fatal().Msg("Set only one of API_KEYS_FILE and API_KEYS_DIR")
+	case apiKeysFile != "":
+		keyStore, err = auth.NewFileStore(apiKeysFile)
+	case apiKeysDir != "":
+		keyStore, err = auth.NewBadgerStore(apiKeysDir)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load API keys")
+	}
+	var authenticator *auth.Authenticator
+	if keyStore != nil {
+		defer keyStore.Close()
+		authenticator = auth.NewAuthenticator(keyStore)
+	}
+
+	// Initialize URL signing, if configured
+	var signer *signing.Signer
+	if len(signingSecrets) > 0 {
+		signer, err = signing.NewSigner(signingSecrets)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid SIGNING_SECRETS")
+		}
+	} else if signedURLsRequired {
+		log.Fatal().Msg("SIGNED_URLS_REQUIRED needs SIGNING_SECRETS")
+	}
+
+	// Initialize rate limiters: per IP for every request, then per API key
+	// once a key is accepted
+	ipLimiter := ratelimit.NewIPRateLimiter(rateLimit, rateBurst)
+	defer ipLimiter.Cleanup()
+	keyLimiter := ratelimit.NewIPRateLimiter(rateLimit, rateBurst,
+		ratelimit.WithIdentity(auth.RateLimitIdentity), ratelimit.WithIdentifiedOnly())
+	defer keyLimiter.Cleanup()
+
+	// Initialize fetcher with SSRF protection
+	destPolicy, err := proxy.NewDestinationPolicy(destAllowCIDRs, destDenyCIDRs)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid destination CIDR configuration")
+	}
+	if hostDefaultPolicy != proxy.ActionAllow && hostDefaultPolicy != proxy.ActionDeny {
+		log.Fatal().Str("policy", hostDefaultPolicy).Msg("HOST_DEFAULT_POLICY must be allow or deny")
+	}
+	hostRules, err := proxy.NewHostRules(nil, hostDefaultPolicy == proxy.ActionAllow)
+	if hostRulesFile != "" {
+		hostRules, err = proxy.LoadHostRules(hostRulesFile, hostDefaultPolicy == proxy.ActionAllow)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load host rules")
+	}
+	secrets, err := proxy.LoadSecrets(secretsFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load secrets")
+	}
+	if err := hostRules.ResolveSecrets(secrets.Lookup); err != nil {
+		log.Fatal().Err(err).Msg("Failed to resolve host rule secrets")
+	}
+	if err := hostRules.CheckTTL(cacheTTL); err != nil {
+		log.Fatal().Err(err).Msg("Host rule ttl must not exceed CACHE_TTL")
+	}
+	fetcher := proxy.NewFetcher(fetchTimeout, maxResponseSize,
+		proxy.WithDestinationPolicy(destPolicy),
+		proxy.WithHostRules(hostRules),
+		proxy.WithLatencyObserver(m.ObserveUpstream),
+		proxy.WithUpstreamEncoding(upstreamEncoding),
+	)
 
 	// Initialize proxy handler
-	proxyHandler := handler.NewProxyHandler(badgerCache, fetcher)
+	keyNormalizer := cache.NewKeyNormalizer(cacheKeyStripParams)
+	handlerOpts := []handler.Option{
+		handler.WithMaxCacheEntrySize(maxCacheEntrySize),
+		handler.WithMaxRequestBodySize(maxRequestBody),
+		handler.WithHeaderPolicies(
+			proxy.NewHeaderPolicy(requestHeadersAllow, requestHeadersDeny, forwardCookies),
+			proxy.NewHeaderPolicy(responseHeadersAllow, responseHeadersDeny, forwardCookies),
+		),
+		handler.WithCacheableStatuses(cacheableStatuses),
+		handler.WithNegativeTTL(negativeTTL, negativeTTLs),
+		handler.WithStaleWindows(staleWhileRevalidate, staleIfError),
+		handler.WithKeyNormalizer(keyNormalizer),
+		handler.WithMaxDecodedSize(maxDecodedSize),
+	}
+	if compression {
+		handlerOpts = append(handlerOpts, handler.WithCompression(compressionLevel, compressionMinSize))
+	}
+	proxyHandler := handler.NewProxyHandler(tieredCache, fetcher, handlerOpts...)
+
+	m.GaugeFunc("proxy_ratelimit_tracked_ips", "Client IPs currently tracked by the rate limiter.",
+		func() int64 { return int64(ipLimiter.Len()) })
+	m.CounterFunc("proxy_ratelimit_rejected_total", "Requests rejected with 429 by the rate limiter.",
+		func() int64 { return ipLimiter.Rejected() + keyLimiter.Rejected() })
+	m.CounterFunc("proxy_coalesced_requests_total", "Requests served from another request's upstream fetch.", proxyHandler.Coalesced)
+	m.CounterFunc("proxy_aborted_responses_total", "Responses aborted mid-stream for exceeding the size limit.", proxyHandler.Aborted)
 
 	// Build middleware chain
-	var h http.Handler = proxyHandler
-	h = limiter.Middleware(h)
+	h := proxyChain(proxyHandler, ipLimiter, keyLimiter, authenticator, signer, signedURLsRequired, corsPolicy)
+	h = m.Middleware(h)
 	h = loggingMiddleware(h)
 
 	// Create HTTP server
 	mux := http.NewServeMux()
 	mux.Handle("/", h)
 	mux.HandleFunc("/health", healthHandler)
+	mux.Handle("/metrics", m.Handler())
+	if adminToken != "" {
+		cacheAdmin := handler.NewAdminHandler(tieredCache, adminToken,
+			handler.WithAdminKeyNormalizer(keyNormalizer),
+			handler.WithAdminFetcher(fetcher),
+		)
+		mux.Handle("/admin/cache", loggingMiddleware(cacheAdmin))
+		mux.Handle("/admin/cache/stats", loggingMiddleware(handler.NewStatsHandler(tieredCache, adminToken)))
+		if keyStore != nil {
+			mux.Handle("/admin/keys", loggingMiddleware(handler.NewKeyAdminHandler(keyStore, authenticator, adminToken)))
+		}
+	}
 
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      mux,
+		Handler:      routeProxyPaths(mux, h),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
@@ -130,6 +302,40 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// proxyChain wraps the proxy handler in access control. The per-IP limit
+// comes first, so requests rejected for a bad key, signature or origin
+// still count against it.
+func proxyChain(next http.Handler, ipLimiter, keyLimiter *ratelimit.IPRateLimiter, authenticator *auth.Authenticator,
+	signer *signing.Signer, signedURLsRequired bool, corsPolicy *cors.Policy) http.Handler {
+	h := keyLimiter.Middleware(next)
+	unsigned := h
+	if authenticator != nil {
+		unsigned = authenticator.Middleware(h)
+	} else if signedURLsRequired {
+		unsigned = nil
+	}
+	if signer != nil {
+		// Signed URLs stand in for an API key
+		h = signer.Middleware(h, unsigned)
+	} else {
+		h = unsigned
+	}
+	h = corsPolicy.Middleware(h)
+	return ipLimiter.Middleware(h)
+}
+
+// routeProxyPaths sends path-style proxy URLs straight to the proxy handler.
+// ServeMux would otherwise clean the "//" in /https://... and redirect.
+func routeProxyPaths(mux *http.ServeMux, proxyHandler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler.IsProxyPath(r.URL.Path) {
+			proxyHandler.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
 // healthHandler returns server health status
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -144,6 +350,64 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvIntList(key string, defaultValue []int) []int {
+	items := getEnvList(key, nil)
+	if items == nil {
+		return defaultValue
+	}
+
+	var list []int
+	for _, item := range items {
+		if i, err := strconv.Atoi(item); err == nil {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+// getEnvDurationMap parses "404=1m,410=1h" into per-status durations
+func getEnvDurationMap(key string) map[int]time.Duration {
+	durations := make(map[int]time.Duration)
+	for _, item := range getEnvList(key, nil) {
+		code, value, ok := strings.Cut(item, "=")
+		if !ok {
+			continue
+		}
+		status, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil {
+			continue
+		}
+		if d, err := time.ParseDuration(strings.TrimSpace(value)); err == nil {
+			durations[status] = d
+		}
+	}
+	return durations
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return defaultValue
+}
+
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 	if value := os.Getenv(key); value != "" {
 		if d, err := time.ParseDuration(value); err == nil {
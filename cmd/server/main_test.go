@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/harold/proxy-harold/internal/auth"
+	"github.com/harold/proxy-harold/internal/cors"
+	"github.com/harold/proxy-harold/internal/ratelimit"
+)
+
+func TestProxyChain_LimitsRejectedKeysPerIP(t *testing.T) {
+	store, err := auth.NewFileStore(t.TempDir() + "/keys.json")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	store.Put(&auth.Key{Key: "k1", Rate: 100, Burst: 100})
+
+	ipLimiter := ratelimit.NewIPRateLimiter(1, 3)
+	defer ipLimiter.Cleanup()
+	keyLimiter := ratelimit.NewIPRateLimiter(1, 3,
+		ratelimit.WithIdentity(auth.RateLimitIdentity), ratelimit.WithIdentifiedOnly())
+	defer keyLimiter.Cleanup()
+	corsPolicy, _ := cors.NewPolicy(nil, false)
+
+	h := proxyChain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ipLimiter, keyLimiter, auth.NewAuthenticator(store), nil, false, corsPolicy)
+
+	// Guessing keys runs into the per-IP limit
+	var codes []int
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url=https://example.com&key=guess", nil))
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusUnauthorized || codes[4] != http.StatusTooManyRequests {
+		t.Errorf("expected 401s and then 429, got %v", codes)
+	}
+
+	// Other clients are unaffected
+	req := httptest.NewRequest("GET", "/?url=https://example.com&key=k1", nil)
+	req.RemoteAddr = "192.0.2.2:1"
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a valid key from another IP to pass, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/signing"
+)
+
+// runSign implements "sign", which prints a signed proxy URL using the
+// first of SIGNING_SECRETS
+func runSign(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("sign", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	target := flags.String("url", "", "target URL to sign (required)")
+	ttl := flags.Duration("ttl", time.Hour, "how long the signed URL stays valid")
+	base := flags.String("base", "http://localhost:"+getEnv("PORT", "8888")+"/", "public base URL of the proxy")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: server sign -url <target> [-ttl 1h] [-base https://proxy.example.com/]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *target == "" || *ttl <= 0 {
+		flags.Usage()
+		return 2
+	}
+
+	signer, err := signing.NewSigner(getEnvList("SIGNING_SECRETS", nil))
+	if err != nil {
+		fmt.Fprintln(stderr, "SIGNING_SECRETS:", err)
+		return 1
+	}
+	signed, err := signer.SignURL(*base, *target, time.Now().Add(*ttl))
+	if err != nil {
+		fmt.Fprintln(stderr, "invalid base URL:", err)
+		return 1
+	}
+	fmt.Fprintln(stdout, signed)
+	return 0
+}
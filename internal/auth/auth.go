@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/cors"
+	"github.com/harold/proxy-harold/internal/httperror"
+	"github.com/harold/proxy-harold/internal/ratelimit"
+)
+
+// KeyHeader carries the API key; the "key" query parameter is the fallback
+const KeyHeader = "X-API-Key"
+
+type contextKey struct{}
+
+// FromContext returns the API key that authenticated a request
+func FromContext(ctx context.Context) (*Key, bool) {
+	key, ok := ctx.Value(contextKey{}).(*Key)
+	return key, ok
+}
+
+// NewContext returns a context carrying an authenticated key
+func NewContext(ctx context.Context, key *Key) context.Context {
+	return context.WithValue(ctx, contextKey{}, key)
+}
+
+// RateLimitIdentity gives authenticated requests their key's rate limit
+func RateLimitIdentity(r *http.Request) (ratelimit.Identity, bool) {
+	key, ok := FromContext(r.Context())
+	if !ok {
+		return ratelimit.Identity{}, false
+	}
+	return ratelimit.Identity{Key: key.Key, Rate: key.Rate, Burst: key.Burst}, true
+}
+
+// Authenticator requires a valid API key and enforces its origin binding
+// and daily quotas. Usage is counted in memory and resets on restart.
+type Authenticator struct {
+	store Store
+	now   func() time.Time
+
+	mu    sync.Mutex
+	usage map[string]*Usage
+}
+
+// Usage is a key's consumption for one UTC day
+type Usage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// NewAuthenticator creates an authenticator backed by a key store
+func NewAuthenticator(store Store) *Authenticator {
+	return &Authenticator{
+		store: store,
+		now:   time.Now,
+		usage: make(map[string]*Usage),
+	}
+}
+
+// Usage returns today's usage for a key
+func (a *Authenticator) Usage(key string) Usage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return *a.today(key)
+}
+
+// Middleware rejects requests without a valid key with 401, from
+// disallowed origins with 403 and over quota with 429. CORS preflight
+// requests pass through, as browsers never attach credentials to them.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		secret := extractKey(r)
+		if secret == "" {
+			httperror.Write(w, "missing API key", http.StatusUnauthorized)
+			return
+		}
+		key, found, err := a.store.Get(secret)
+		if err != nil {
+			httperror.Write(w, "failed to look up API key", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			httperror.Write(w, "invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		if !key.AllowsOrigin(cors.RequestOrigin(r)) {
+			httperror.Write(w, "origin not allowed for this API key", http.StatusForbidden)
+			return
+		}
+
+		if message := a.reserve(key); message != "" {
+			w.Header().Set("Retry-After", strconv.Itoa(a.secondsUntilReset()))
+			httperror.Write(w, message, http.StatusTooManyRequests)
+			return
+		}
+
+		// Deferred so aborted streams still count what was sent
+		counter := &countingWriter{ResponseWriter: w}
+		defer func() { a.addBytes(key.Key, counter.bytes) }()
+		next.ServeHTTP(counter, r.WithContext(NewContext(r.Context(), key)))
+	})
+}
+
+// extractKey reads the key from the header, or from the "key" query
+// parameter, which is then removed so it never reaches the target URL.
+// The query of a path-style target ("/https://host/path?query") belongs to
+// the target and is left alone.
+func extractKey(r *http.Request) string {
+	if key := r.Header.Get(KeyHeader); key != "" {
+		return key
+	}
+	if r.URL.Path != "/" && !strings.HasPrefix(r.URL.Path, "/raw/") {
+		return ""
+	}
+
+	key := r.URL.Query().Get("key")
+	if key != "" {
+		r.URL.RawQuery = removeQueryParam(r.URL.RawQuery, "key")
+	}
+	return key
+}
+
+// removeQueryParam drops a parameter from a raw query, keeping the order
+// and encoding of everything else intact
+func removeQueryParam(rawQuery, name string) string {
+	parts := strings.Split(rawQuery, "&")
+	kept := parts[:0]
+	for _, part := range parts {
+		param, _, _ := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(param); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
+
+// reserve counts a request against the key's quotas, or returns why it
+// is over quota
+func (a *Authenticator) reserve(key *Key) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	usage := a.today(key.Key)
+	if key.DailyRequests > 0 && usage.Requests >= key.DailyRequests {
+		return "daily request quota exceeded"
+	}
+	if key.DailyBytes > 0 && usage.Bytes >= key.DailyBytes {
+		return "daily byte quota exceeded"
+	}
+	usage.Requests++
+	return ""
+}
+
+func (a *Authenticator) addBytes(key string, n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.today(key).Bytes += n
+}
+
+// today returns the key's usage for the current day; the caller holds the lock
+func (a *Authenticator) today(key string) *Usage {
+	day := a.now().UTC().Format(time.DateOnly)
+	usage, ok := a.usage[key]
+	if !ok || usage.Day != day {
+		usage = &Usage{Day: day}
+		a.usage[key] = usage
+	}
+	return usage
+}
+
+// secondsUntilReset returns the time until quotas reset at UTC midnight
+func (a *Authenticator) secondsUntilReset() int {
+	now := a.now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return int(midnight.Sub(now).Seconds()) + 1
+}
+
+// countingWriter counts response body bytes for the byte quota
+type countingWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
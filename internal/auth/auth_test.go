@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestAuthenticator(t *testing.T, keys ...*Key) *Authenticator {
+	t.Helper()
+
+	store, err := NewFileStore(t.TempDir() + "/keys.json")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	for _, key := range keys {
+		if err := store.Put(key); err != nil {
+			t.Fatalf("failed to add key: %v", err)
+		}
+	}
+	return NewAuthenticator(store)
+}
+
+func serve(h http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestMiddleware_RequiresValidKey(t *testing.T) {
+	a := newTestAuthenticator(t, &Key{Key: "k1"})
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, ok := FromContext(r.Context())
+		if !ok || key.Key != "k1" {
+			t.Error("expected the key in the request context")
+		}
+	}))
+
+	tests := []struct {
+		target string
+		header http.Header
+		want   int
+	}{
+		{"/?url=https://example.com", nil, http.StatusUnauthorized},
+		{"/?url=https://example.com&key=nope", nil, http.StatusUnauthorized},
+		{"/?url=https://example.com&key=k1", nil, http.StatusOK},
+		{"/?url=https://example.com", http.Header{"X-Api-Key": {"k1"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := serve(h, tt.target, tt.header); rec.Code != tt.want {
+			t.Errorf("%s %v: expected %d, got %d", tt.target, tt.header, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestMiddleware_PreflightNeedsNoKey(t *testing.T) {
+	a := newTestAuthenticator(t)
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest("OPTIONS", "/?url=https://example.com", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+}
+
+func TestMiddleware_StripsKeyFromQuery(t *testing.T) {
+	a := newTestAuthenticator(t, &Key{Key: "k1"})
+
+	var rawQuery string
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawQuery = r.URL.RawQuery
+	}))
+
+	serve(h, "/?b=2&key=k1&url=https%3A%2F%2Fexample.com%2F", nil)
+	if rawQuery != "b=2&url=https%3A%2F%2Fexample.com%2F" {
+		t.Errorf("expected key removed and the rest untouched, got %q", rawQuery)
+	}
+
+	// The query of a path-style target is the target's own
+	rec := serve(h, "/https://example.com/search?b=2&key=k1&a=%2F", http.Header{"X-Api-Key": {"k1"}})
+	if rec.Code != http.StatusOK || rawQuery != "b=2&key=k1&a=%2F" {
+		t.Errorf("expected the target query untouched, got %d %q", rec.Code, rawQuery)
+	}
+	if rec := serve(h, "/https://example.com/search?key=k1", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a target's key parameter not to authenticate, got %d", rec.Code)
+	}
+}
+
+func TestMiddleware_EnforcesAllowedOrigins(t *testing.T) {
+	a := newTestAuthenticator(t, &Key{
+		Key:            "k1",
+		AllowedOrigins: []string{"https://app.example.com", "https://*.partner.org"},
+	})
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		header http.Header
+		want   int
+	}{
+		{http.Header{"Origin": {"https://app.example.com"}}, http.StatusOK},
+		{http.Header{"Origin": {"https://a.b.partner.org"}}, http.StatusOK},
+		{http.Header{"Referer": {"https://app.example.com/page?x=1"}}, http.StatusOK},
+		{http.Header{"Origin": {"http://app.example.com"}}, http.StatusForbidden},
+		{http.Header{"Origin": {"https://partner.org"}}, http.StatusForbidden},
+		{http.Header{"Origin": {"https://evil.com"}}, http.StatusForbidden},
+		{http.Header{}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		tt.header.Set("X-API-Key", "k1")
+		if rec := serve(h, "/?url=https://example.com", tt.header); rec.Code != tt.want {
+			t.Errorf("%v: expected %d, got %d", tt.header, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestMiddleware_EnforcesDailyQuotas(t *testing.T) {
+	a := newTestAuthenticator(t,
+		&Key{Key: "requests", DailyRequests: 2},
+		&Key{Key: "bytes", DailyBytes: 10},
+	)
+	now := time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("123456"))
+	}))
+	header := func(key string) http.Header { return http.Header{"X-Api-Key": {key}} }
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if rec := serve(h, "/?url=https://example.com", header("requests")); rec.Code != want {
+			t.Errorf("request %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+
+	// 6 bytes, then 12: the quota is checked before each request
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := serve(h, "/?url=https://example.com", header("bytes"))
+		if rec.Code != want {
+			t.Errorf("bytes request %d: expected %d, got %d", i, want, rec.Code)
+		}
+		if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "3601" {
+			t.Errorf("expected Retry-After until midnight, got %q", rec.Header().Get("Retry-After"))
+		}
+	}
+	if usage := a.Usage("bytes"); usage.Requests != 2 || usage.Bytes != 12 {
+		t.Errorf("unexpected usage: %+v", usage)
+	}
+
+	// Quotas reset the next day
+	now = now.Add(2 * time.Hour)
+	if rec := serve(h, "/?url=https://example.com", header("requests")); rec.Code != http.StatusOK {
+		t.Errorf("expected quota reset, got %d", rec.Code)
+	}
+}
+
+func TestKey_AllowsHost(t *testing.T) {
+	key := &Key{AllowedHosts: []string{"api.example.com", "*.partner.org"}}
+
+	tests := map[string]bool{
+		"api.example.com": true,
+		"API.example.com": true,
+		"cdn.partner.org": true,
+		"partner.org":     false,
+		"example.com":     false,
+	}
+	for host, want := range tests {
+		if got := key.AllowsHost(host); got != want {
+			t.Errorf("AllowsHost(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	if !(&Key{}).AllowsHost("anything.example") {
+		t.Error("expected keys without allowed hosts to allow any host")
+	}
+}
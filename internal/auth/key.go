@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/harold/proxy-harold/internal/proxy"
+)
+
+// Key is an API key and the limits that apply to its requests
+type Key struct {
+	// Key is the secret sent by clients
+	Key  string `json:"key"`
+	Name string `json:"name,omitempty"`
+
+	// Rate and Burst replace the per-IP rate limit; zero uses the default
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+
+	// DailyRequests and DailyBytes cap usage per UTC day; zero is unlimited
+	DailyRequests int64 `json:"daily_requests,omitempty"`
+	DailyBytes    int64 `json:"daily_bytes,omitempty"`
+
+	// AllowedOrigins restricts the Origin or Referer the key may be used
+	// from, e.g. "https://app.example.com" or "https://*.example.com"
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+
+	// AllowedHosts restricts destination hosts, e.g. "api.example.com" or
+	// "*.example.com"
+	AllowedHosts []string `json:"allowed_hosts,omitempty"`
+}
+
+// AllowsOrigin reports whether the key may be used from an origin such as
+// "https://app.example.com". Keys without allowed origins accept any.
+func (k *Key) AllowsOrigin(origin string) bool {
+	if len(k.AllowedOrigins) == 0 {
+		return true
+	}
+	if origin == "" {
+		return false
+	}
+
+	scheme, host, ok := strings.Cut(strings.ToLower(origin), "://")
+	if !ok {
+		return false
+	}
+	for _, pattern := range k.AllowedOrigins {
+		patternScheme, patternHost, ok := strings.Cut(strings.ToLower(pattern), "://")
+		if ok && patternScheme == scheme && proxy.MatchHost(patternHost, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsHost reports whether the key may reach a destination host.
+// Keys without allowed hosts accept any.
+func (k *Key) AllowsHost(host string) bool {
+	if len(k.AllowedHosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	for _, pattern := range k.AllowedHosts {
+		if proxy.MatchHost(strings.ToLower(pattern), host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// ErrInvalidKey is returned when storing a key without a secret
+var ErrInvalidKey = errors.New("API key must not be empty")
+
+// Store persists API keys
+type Store interface {
+	Get(key string) (*Key, bool, error)
+	List() ([]*Key, error)
+	Put(key *Key) error
+	Delete(key string) error
+	Close() error
+}
+
+// FileStore keeps API keys in a JSON file holding an array of keys.
+// The file is read once and rewritten on every change.
+type FileStore struct {
+	path string
+	mu   sync.RWMutex
+	keys map[string]*Key
+}
+
+// NewFileStore loads keys from path. A missing file is created on the
+// first change.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path: path,
+		keys: make(map[string]*Key),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Key == "" {
+			return nil, ErrInvalidKey
+		}
+		s.keys[key.Key] = key
+	}
+
+	return s, nil
+}
+
+// Get returns a key by its secret
+func (s *FileStore) Get(key string) (*Key, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[key]
+	return k, ok, nil
+}
+
+// List returns all keys ordered by secret
+func (s *FileStore) List() ([]*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sorted(), nil
+}
+
+// Put adds or replaces a key
+func (s *FileStore) Put(key *Key) error {
+	if key.Key == "" {
+		return ErrInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.keys[key.Key]
+	s.keys[key.Key] = key
+	if err := s.save(); err != nil {
+		if existed {
+			s.keys[key.Key] = previous
+		} else {
+			delete(s.keys, key.Key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a key
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.keys[key]
+	if !existed {
+		return nil
+	}
+	delete(s.keys, key)
+	if err := s.save(); err != nil {
+		s.keys[key] = previous
+		return err
+	}
+	return nil
+}
+
+// Close is a no-op; every change is already written
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// sorted returns the keys in a stable order; the caller holds the lock
+func (s *FileStore) sorted() []*Key {
+	keys := make([]*Key, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Key < keys[j].Key })
+	return keys
+}
+
+// save writes the file atomically; the caller holds the write lock
+func (s *FileStore) save() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// keyPrefix namespaces API keys in BadgerDB
+const keyPrefix = "key/"
+
+// BadgerStore keeps API keys in their own BadgerDB directory
+type BadgerStore struct {
+	db *badger.DB
+}
+
+// NewBadgerStore opens or creates a key database at path
+func NewBadgerStore(path string) (*BadgerStore, error) {
+	opts := badger.DefaultOptions(path)
+	opts.Logger = nil
+
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerStore{db: db}, nil
+}
+
+// Get returns a key by its secret
+func (s *BadgerStore) Get(key string) (*Key, bool, error) {
+	var k Key
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(keyPrefix + key))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &k)
+		})
+	})
+
+	if err == badger.ErrKeyNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return &k, true, nil
+}
+
+// List returns all keys ordered by secret
+func (s *BadgerStore) List() ([]*Key, error) {
+	var keys []*Key
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(keyPrefix)
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			var k Key
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &k)
+			})
+			if err != nil {
+				return err
+			}
+			keys = append(keys, &k)
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Put adds or replaces a key
+func (s *BadgerStore) Put(key *Key) error {
+	if key.Key == "" {
+		return ErrInvalidKey
+	}
+
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(keyPrefix+key.Key), value)
+	})
+}
+
+// Delete removes a key
+func (s *BadgerStore) Delete(key string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte(keyPrefix + key))
+	})
+}
+
+// Close closes the database
+func (s *BadgerStore) Close() error {
+	return s.db.Close()
+}
+
+// Ensure both stores implement Store
+var (
+	_ Store = (*FileStore)(nil)
+	_ Store = (*BadgerStore)(nil)
+)
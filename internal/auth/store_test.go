@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"testing"
+)
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+
+	if err := store.Put(&Key{Key: "b", Name: "second", DailyRequests: 10}); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if err := store.Put(&Key{Key: "a", Name: "first", AllowedHosts: []string{"example.com"}}); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if err := store.Put(&Key{}); err != ErrInvalidKey {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+
+	key, found, err := store.Get("a")
+	if err != nil || !found {
+		t.Fatalf("expected to find key: %v", err)
+	}
+	if key.Name != "first" || len(key.AllowedHosts) != 1 {
+		t.Errorf("unexpected key: %+v", key)
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	if len(keys) != 2 || keys[0].Key != "a" || keys[1].Key != "b" {
+		t.Errorf("unexpected keys: %+v", keys)
+	}
+
+	if err := store.Delete("a"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, found, _ := store.Get("a"); found {
+		t.Error("expected key to be deleted")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := t.TempDir() + "/keys.json"
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	testStore(t, store)
+
+	// Changes are persisted
+	reloaded, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("failed to reload store: %v", err)
+	}
+	key, found, _ := reloaded.Get("b")
+	if !found || key.DailyRequests != 10 {
+		t.Errorf("expected key to survive a reload, got %+v", key)
+	}
+}
+
+func TestBadgerStore(t *testing.T) {
+	store, err := NewBadgerStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	defer store.Close()
+
+	testStore(t, store)
+}
@@ -3,7 +3,10 @@ package cache
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
@@ -11,38 +14,129 @@ import (
 
 // Cache interface defines the caching operations
 type Cache interface {
-	Get(url string) (data []byte, contentType string, found bool, err error)
-	Set(url string, data []byte, contentType string) error
+	// Get returns the stored entry, which may be past its freshness lifetime
+	Get(url string) (*CachedResponse, bool, error)
+	// Set stores an entry until its ExpiresAt. A zero ExpiresAt uses the
+	// cache default, which is also the upper bound for any entry.
+	Set(url string, response *CachedResponse) error
 	Delete(url string) error
 	Close() error
 }
 
 // CachedResponse stores the response data and metadata
 type CachedResponse struct {
-	Data        []byte `json:"data"`
-	ContentType string `json:"content_type"`
+	// StatusCode is the upstream status; zero means 200 for older entries
+	StatusCode   int         `json:"status_code,omitempty"`
+	Data         []byte      `json:"data"`
+	ContentType  string      `json:"content_type"`
+	Header       http.Header `json:"header,omitempty"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"last_modified,omitempty"`
+	StoredAt     time.Time   `json:"stored_at"`
+	ExpiresAt    time.Time   `json:"expires_at"`
+
+	// StaleWhileRevalidate and StaleIfError are how long after ExpiresAt
+	// the entry may still be served, see RFC 5861
+	StaleWhileRevalidate time.Duration `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         time.Duration `json:"stale_if_error,omitempty"`
+
+	// Vary holds the request header fields the response varies on
+	Vary []string `json:"vary,omitempty"`
+	// Variants lists the URLs of the stored variants, oldest first. It is
+	// only set on the entry standing in for a URL whose responses vary,
+	// which is never served itself.
+	Variants []string `json:"variants,omitempty"`
+
+	// StoredSize is the encoded size in the cache, set when read or written
+	StoredSize int `json:"-"`
+}
+
+// Status returns the HTTP status code to serve the entry with
+func (r *CachedResponse) Status() int {
+	if r.StatusCode == 0 {
+		return http.StatusOK
+	}
+	return r.StatusCode
+}
+
+// IsFresh reports whether the entry can be served without revalidation
+func (r *CachedResponse) IsFresh(now time.Time) bool {
+	return now.Before(r.ExpiresAt)
+}
+
+// CanServeStale reports whether a stale entry may be served while it is
+// revalidated in the background
+func (r *CachedResponse) CanServeStale(now time.Time) bool {
+	return now.Before(r.ExpiresAt.Add(r.StaleWhileRevalidate))
+}
+
+// CanServeOnError reports whether a stale entry may be served in place of
+// an upstream error
+func (r *CachedResponse) CanServeOnError(now time.Time) bool {
+	return now.Before(r.ExpiresAt.Add(r.StaleIfError))
+}
+
+// HasValidators reports whether the entry can be revalidated upstream
+func (r *CachedResponse) HasValidators() bool {
+	return r.ETag != "" || r.LastModified != ""
 }
 
 // BadgerCache implements Cache using BadgerDB
 type BadgerCache struct {
-	db  *badger.DB
-	ttl time.Duration
+	db               *badger.DB
+	ttl              time.Duration
+	revalidateWindow time.Duration
+	compress         bool
+	maxVariants      int
+	quota            quota
+
+	// varyMu serializes updates of the entries listing a URL's variants
+	varyMu sync.Mutex
+}
+
+// Option configures a BadgerCache
+type Option func(*BadgerCache)
+
+// WithRevalidationWindow keeps entries that carry validators for d after
+// they go stale, so they can be revalidated instead of refetched
+func WithRevalidationWindow(d time.Duration) Option {
+	return func(c *BadgerCache) {
+		c.revalidateWindow = d
+	}
+}
+
+// WithCompression zstd-compresses the stored bodies of text-like content
+// types. Entries are readable either way.
+func WithCompression(enabled bool) Option {
+	return func(c *BadgerCache) {
+		c.compress = enabled
+	}
 }
 
 // NewBadgerCache creates a new BadgerDB-backed cache
-func NewBadgerCache(path string, ttl time.Duration) (*BadgerCache, error) {
-	opts := badger.DefaultOptions(path)
-	opts.Logger = nil // Disable BadgerDB logging
+func NewBadgerCache(path string, ttl time.Duration, opts ...Option) (*BadgerCache, error) {
+	badgerOpts := badger.DefaultOptions(path)
+	badgerOpts.Logger = nil // Disable BadgerDB logging
 
-	db, err := badger.Open(opts)
+	db, err := badger.Open(badgerOpts)
 	if err != nil {
 		return nil, err
 	}
 
-	return &BadgerCache{
-		db:  db,
-		ttl: ttl,
-	}, nil
+	c := &BadgerCache{
+		db:          db,
+		ttl:         ttl,
+		maxVariants: DefaultMaxVariants,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.startMaintenance(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return c, nil
 }
 
 // GenerateCacheKey creates a deterministic key from a URL
@@ -51,62 +145,270 @@ func GenerateCacheKey(url string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// Index keys map URLs and hosts back to the hashed entry keys, so entries
+// can be purged without knowing every URL. They share the entry's TTL.
+const (
+	urlIndexPrefix  = "idx/url/"
+	hostIndexPrefix = "idx/host/"
+)
+
+// indexKeys returns the index keys for a URL
+func indexKeys(rawURL string) [][]byte {
+	keys := [][]byte{[]byte(urlIndexPrefix + rawURL)}
+	if host := hostOf(rawURL); host != "" {
+		keys = append(keys, []byte(hostIndexPrefix+host+"/"+rawURL))
+	}
+	return keys
+}
+
+// hostOf returns the lowercased hostname of a URL, without port
+func hostOf(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
 // Get retrieves a cached response
-func (c *BadgerCache) Get(url string) ([]byte, string, bool, error) {
+func (c *BadgerCache) Get(url string) (*CachedResponse, bool, error) {
+	response, _, found, err := c.get(url)
+	return response, found, err
+}
+
+// get retrieves a cached response and when Badger will drop it
+func (c *BadgerCache) get(url string) (*CachedResponse, time.Time, bool, error) {
 	key := GenerateCacheKey(url)
 
-	var response CachedResponse
+	var response *CachedResponse
+	var retainUntil time.Time
 	err := c.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(key))
 		if err != nil {
 			return err
 		}
+		retainUntil = time.Unix(int64(item.ExpiresAt()), 0)
 
 		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &response)
+			decoded, err := decodeEntry(val)
+			if err != nil {
+				return err
+			}
+			decoded.StoredSize = len(val)
+			response = decoded
+			return nil
 		})
 	})
 
 	if err == badger.ErrKeyNotFound {
-		return nil, "", false, nil
+		return nil, time.Time{}, false, nil
 	}
 	if err != nil {
-		return nil, "", false, err
+		return nil, time.Time{}, false, err
 	}
 
-	return response.Data, response.ContentType, true, nil
+	c.touch(url)
+	return response, retainUntil, true, nil
 }
 
 // Set stores a response in the cache with TTL
-func (c *BadgerCache) Set(url string, data []byte, contentType string) error {
-	key := GenerateCacheKey(url)
+func (c *BadgerCache) Set(url string, response *CachedResponse) error {
+	_, _, err := c.set(url, response)
+	return err
+}
 
-	response := CachedResponse{
-		Data:        data,
-		ContentType: contentType,
+// set stores a response and returns the stored entry and when Badger will
+// drop it, or a nil entry if it was not stored. Writes are refused without
+// an error while the disk is full.
+func (c *BadgerCache) set(url string, response *CachedResponse) (*CachedResponse, time.Time, error) {
+	now := time.Now()
+	if c.quota.refusing(now) {
+		c.quota.refused.Add(1)
+		return nil, time.Time{}, nil
 	}
 
-	value, err := json.Marshal(response)
-	if err != nil {
-		return err
+	ttl := c.ttl
+	if !response.ExpiresAt.IsZero() {
+		ttl = min(response.ExpiresAt.Sub(now), c.ttl)
 	}
+	ttl = max(ttl, 0)
+
+	stored := *response
+	stored.StoredAt = now
+	stored.ExpiresAt = now.Add(ttl)
+
+	// Keep entries around after they go stale for as long as they may
+	// still be revalidated or served stale
+	grace := max(stored.StaleWhileRevalidate, stored.StaleIfError)
+	if stored.HasValidators() {
+		grace = max(grace, c.revalidateWindow)
+	}
+	retention := ttl + grace
+	if retention <= 0 {
+		return nil, time.Time{}, nil
+	}
+	return c.write(url, &stored, retention)
+}
 
-	return c.db.Update(func(txn *badger.Txn) error {
-		entry := badger.NewEntry([]byte(key), value).WithTTL(c.ttl)
-		return txn.SetEntry(entry)
+// write encodes an entry and stores it for retention
+func (c *BadgerCache) write(url string, stored *CachedResponse, retention time.Duration) (*CachedResponse, time.Time, error) {
+	key := GenerateCacheKey(url)
+	now := time.Now()
+	value := encodeEntry(stored, c.compress)
+	stored.StoredSize = len(value)
+
+	err := c.db.Update(func(txn *badger.Txn) error {
+		entry := badger.NewEntry([]byte(key), value).WithTTL(retention)
+		if err := txn.SetEntry(entry); err != nil {
+			return err
+		}
+		// The URL index, first, also records what the quota needs to know
+		keys := indexKeys(url)
+		if err := txn.SetEntry(badger.NewEntry(keys[0], indexValue(len(value), now)).WithTTL(retention)); err != nil {
+			return err
+		}
+		for _, indexKey := range keys[1:] {
+			if err := txn.SetEntry(badger.NewEntry(indexKey, []byte(key)).WithTTL(retention)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
+	if c.refuseWrite(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	c.quota.diskFull.Store(false)
+	c.noteWrite(len(value))
+	return stored, now.Add(retention), nil
 }
 
 // Delete removes a cached response
 func (c *BadgerCache) Delete(url string) error {
 	key := GenerateCacheKey(url)
 
-	return c.db.Update(func(txn *badger.Txn) error {
+	err := c.db.Update(func(txn *badger.Txn) error {
+		for _, indexKey := range indexKeys(url) {
+			if err := txn.Delete(indexKey); err != nil {
+				return err
+			}
+		}
 		return txn.Delete([]byte(key))
 	})
+	if err == nil {
+		// The freed space may let writes through again
+		c.quota.diskFull.Store(false)
+	}
+	return err
+}
+
+// PurgePrefix removes every entry whose URL starts with prefix and returns
+// how many were removed. The match is on the raw URL string.
+func (c *BadgerCache) PurgePrefix(prefix string) (int, error) {
+	return c.purgeIndex(urlIndexPrefix + prefix)
+}
+
+// PurgeHost removes every entry for a hostname, across schemes and ports
+func (c *BadgerCache) PurgeHost(host string) (int, error) {
+	return c.purgeIndex(hostIndexPrefix + strings.ToLower(host) + "/")
+}
+
+// PurgeAll removes every entry
+func (c *BadgerCache) PurgeAll() error {
+	if err := c.db.DropAll(); err != nil {
+		return err
+	}
+	c.quota.used.Store(0)
+	c.quota.entries.Store(0)
+	c.quota.diskFull.Store(false)
+	return nil
+}
+
+// purgeIndex removes the entries listed under an index key prefix
+func (c *BadgerCache) purgeIndex(prefix string) (int, error) {
+	var urls []string
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte(prefix)
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			if strings.HasPrefix(key, urlIndexPrefix) {
+				urls = append(urls, strings.TrimPrefix(key, urlIndexPrefix))
+			} else {
+				_, rawURL, _ := strings.Cut(strings.TrimPrefix(key, hostIndexPrefix), "/")
+				urls = append(urls, rawURL)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := c.deleteURLs(urls); err != nil {
+		return 0, err
+	}
+
+	return len(urls), nil
+}
+
+// deleteURLs removes the entries and index keys of many URLs. A write
+// batch splits them over as many transactions as needed.
+func (c *BadgerCache) deleteURLs(urls []string) error {
+	batch := c.db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, rawURL := range urls {
+		for _, indexKey := range indexKeys(rawURL) {
+			if err := batch.Delete(indexKey); err != nil {
+				return err
+			}
+		}
+		if err := batch.Delete([]byte(GenerateCacheKey(rawURL))); err != nil {
+			return err
+		}
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+	c.quota.diskFull.Store(false)
+	return nil
+}
+
+// Stats describes the on-disk state of the cache
+type Stats struct {
+	LSMSize  int64        `json:"lsm_size"`
+	VLogSize int64        `json:"vlog_size"`
+	Levels   []LevelStats `json:"levels"`
+}
+
+// LevelStats describes one level of the LSM tree
+type LevelStats struct {
+	Level     int   `json:"level"`
+	NumTables int   `json:"tables"`
+	Size      int64 `json:"size"`
+}
+
+// Stats returns BadgerDB size and LSM statistics
+func (c *BadgerCache) Stats() Stats {
+	lsm, vlog := c.db.Size()
+	stats := Stats{LSMSize: lsm, VLogSize: vlog}
+	for _, level := range c.db.Levels() {
+		stats.Levels = append(stats.Levels, LevelStats{
+			Level:     level.Level,
+			NumTables: level.NumTables,
+			Size:      level.Size,
+		})
+	}
+	return stats
 }
 
 // Close closes the database
 func (c *BadgerCache) Close() error {
+	c.stopMaintenance()
 	return c.db.Close()
 }
@@ -3,6 +3,8 @@ package cache
 import (
 	"testing"
 	"time"
+
+	"github.com/dgraph-io/badger/v4"
 )
 
 func TestCache_SetAndGet(t *testing.T) {
@@ -13,24 +15,27 @@ func TestCache_SetAndGet(t *testing.T) {
 	defer cache.Close()
 
 	// Test Set
-	err = cache.Set("https://example.com/api", []byte("response data"), "application/json")
+	err = cache.Set("https://example.com/api", &CachedResponse{Data: []byte("response data"), ContentType: "application/json"})
 	if err != nil {
 		t.Fatalf("failed to set cache: %v", err)
 	}
 
 	// Test Get - should return cached data
-	data, contentType, found, err := cache.Get("https://example.com/api")
+	entry, found, err := cache.Get("https://example.com/api")
 	if err != nil {
 		t.Fatalf("failed to get cache: %v", err)
 	}
 	if !found {
 		t.Fatal("expected to find cached data")
 	}
-	if string(data) != "response data" {
-		t.Errorf("expected 'response data', got '%s'", string(data))
+	if string(entry.Data) != "response data" {
+		t.Errorf("expected 'response data', got '%s'", string(entry.Data))
+	}
+	if entry.ContentType != "application/json" {
+		t.Errorf("expected 'application/json', got '%s'", entry.ContentType)
 	}
-	if contentType != "application/json" {
-		t.Errorf("expected 'application/json', got '%s'", contentType)
+	if !entry.IsFresh(time.Now()) {
+		t.Error("expected entry to be fresh")
 	}
 }
 
@@ -42,7 +47,7 @@ func TestCache_GetMiss(t *testing.T) {
 	defer cache.Close()
 
 	// Test Get on non-existent key
-	_, _, found, err := cache.Get("https://nonexistent.com")
+	_, found, err := cache.Get("https://nonexistent.com")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -59,7 +64,7 @@ func TestCache_Delete(t *testing.T) {
 	defer cache.Close()
 
 	// Set a value
-	err = cache.Set("https://example.com", []byte("data"), "text/plain")
+	err = cache.Set("https://example.com", &CachedResponse{Data: []byte("data"), ContentType: "text/plain"})
 	if err != nil {
 		t.Fatalf("failed to set: %v", err)
 	}
@@ -71,7 +76,7 @@ func TestCache_Delete(t *testing.T) {
 	}
 
 	// Verify it's gone
-	_, _, found, _ := cache.Get("https://example.com")
+	_, found, _ := cache.Get("https://example.com")
 	if found {
 		t.Error("expected cache miss after delete")
 	}
@@ -88,13 +93,13 @@ func TestCache_TTLExpiration(t *testing.T) {
 	}
 	defer cache.Close()
 
-	err = cache.Set("https://example.com", []byte("data"), "text/plain")
+	err = cache.Set("https://example.com", &CachedResponse{Data: []byte("data"), ContentType: "text/plain"})
 	if err != nil {
 		t.Fatalf("failed to set: %v", err)
 	}
 
 	// Should exist immediately
-	_, _, found, _ := cache.Get("https://example.com")
+	_, found, _ := cache.Get("https://example.com")
 	if !found {
 		t.Error("expected cache hit before expiration")
 	}
@@ -106,12 +111,125 @@ func TestCache_TTLExpiration(t *testing.T) {
 	cache.db.RunValueLogGC(0.5)
 
 	// Should be gone after GC
-	_, _, found, _ = cache.Get("https://example.com")
+	_, found, _ = cache.Get("https://example.com")
 	if found {
 		t.Log("Note: TTL expiration may take longer depending on GC schedule")
 	}
 }
 
+func TestCache_PerEntryTTLIsCapped(t *testing.T) {
+	cache, err := NewBadgerCache(t.TempDir(), time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	tests := []struct {
+		url  string
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{"https://example.com/short", 5 * time.Second, 5 * time.Second},
+		{"https://example.com/default", 0, time.Minute},
+		{"https://example.com/long", time.Hour, time.Minute},
+	}
+
+	for _, tt := range tests {
+		entry := &CachedResponse{Data: []byte("data"), ContentType: "text/plain"}
+		if tt.ttl > 0 {
+			entry.ExpiresAt = time.Now().Add(tt.ttl)
+		}
+		if err := cache.Set(tt.url, entry); err != nil {
+			t.Fatalf("failed to set: %v", err)
+		}
+
+		var expiresAt uint64
+		cache.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(GenerateCacheKey(tt.url)))
+			if err != nil {
+				return err
+			}
+			expiresAt = item.ExpiresAt()
+			return nil
+		})
+
+		remaining := time.Until(time.Unix(int64(expiresAt), 0))
+		if remaining > tt.want || remaining < tt.want-2*time.Second {
+			t.Errorf("%s: remaining ttl %v, want about %v", tt.url, remaining, tt.want)
+		}
+	}
+}
+
+func TestCache_KeepsRevalidatableEntriesWhenStale(t *testing.T) {
+	cache, err := NewBadgerCache(t.TempDir(), time.Hour, WithRevalidationWindow(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	// Already stale, but carries an ETag
+	err = cache.Set("https://example.com/feed", &CachedResponse{
+		Data:      []byte("data"),
+		ETag:      `"abc"`,
+		ExpiresAt: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	entry, found, err := cache.Get("https://example.com/feed")
+	if err != nil || !found {
+		t.Fatalf("expected stale entry to be kept, found=%v err=%v", found, err)
+	}
+	if entry.IsFresh(time.Now()) {
+		t.Error("expected entry to be stale")
+	}
+	if entry.ETag != `"abc"` {
+		t.Errorf("expected ETag to be stored, got %q", entry.ETag)
+	}
+
+	// Stale entries without validators are not stored at all
+	err = cache.Set("https://example.com/plain", &CachedResponse{Data: []byte("data"), ExpiresAt: time.Now()})
+	if err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+	if _, found, _ := cache.Get("https://example.com/plain"); found {
+		t.Error("expected stale entry without validators to be dropped")
+	}
+}
+
+func TestCache_KeepsEntriesForStaleWindows(t *testing.T) {
+	cache, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	// Expires in a second, but may be served stale for a minute after
+	err = cache.Set("https://example.com/feed", &CachedResponse{
+		Data:         []byte("data"),
+		ExpiresAt:    time.Now().Add(time.Second),
+		StaleIfError: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	entry, found, err := cache.Get("https://example.com/feed")
+	if err != nil || !found {
+		t.Fatalf("expected the entry to be kept, found=%v err=%v", found, err)
+	}
+	now := time.Now()
+	if entry.IsFresh(now) || entry.CanServeStale(now) {
+		t.Error("expected the entry to be stale and past stale-while-revalidate")
+	}
+	if !entry.CanServeOnError(now) {
+		t.Error("expected the entry to be usable on error")
+	}
+}
+
 func TestCache_KeyGeneration(t *testing.T) {
 	// Different URLs should have different keys
 	key1 := GenerateCacheKey("https://example.com/path1")
@@ -125,3 +243,107 @@ func TestCache_KeyGeneration(t *testing.T) {
 		t.Error("same URLs should have same keys")
 	}
 }
+
+func TestCache_Stats(t *testing.T) {
+	cache, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	stats := cache.Stats()
+	if len(stats.Levels) == 0 {
+		t.Error("expected LSM level statistics")
+	}
+	for i, level := range stats.Levels {
+		if level.Level != i {
+			t.Errorf("expected level %d, got %d", i, level.Level)
+		}
+	}
+}
+
+func TestCache_PurgeByPrefixAndHost(t *testing.T) {
+	cache, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	urls := []string{
+		"https://example.com/api/a",
+		"https://example.com/api/b",
+		"http://Example.com:8080/other",
+		"https://example.org/api/a",
+	}
+	for _, url := range urls {
+		if err := cache.Set(url, &CachedResponse{Data: []byte(url)}); err != nil {
+			t.Fatalf("failed to set %s: %v", url, err)
+		}
+	}
+
+	purged, err := cache.PurgePrefix("https://example.com/api/")
+	if err != nil {
+		t.Fatalf("failed to purge prefix: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("expected 2 entries purged by prefix, got %d", purged)
+	}
+
+	purged, err = cache.PurgeHost("EXAMPLE.com")
+	if err != nil {
+		t.Fatalf("failed to purge host: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("expected 1 entry purged by host, got %d", purged)
+	}
+
+	for i, url := range urls {
+		_, found, _ := cache.Get(url)
+		if want := i == 3; found != want {
+			t.Errorf("%s: found = %v, want %v", url, found, want)
+		}
+	}
+
+	// Index entries go with the entry
+	if purged, _ := cache.PurgeHost("example.com"); purged != 0 {
+		t.Errorf("expected nothing left to purge, got %d", purged)
+	}
+}
+
+func TestCache_DeleteRemovesIndex(t *testing.T) {
+	cache, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	cache.Set("https://example.com/a", &CachedResponse{Data: []byte("a")})
+	if err := cache.Delete("https://example.com/a"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	if purged, _ := cache.PurgePrefix("https://example.com/"); purged != 0 {
+		t.Errorf("expected deleted entry to be unindexed, got %d", purged)
+	}
+}
+
+func TestCache_PurgeAll(t *testing.T) {
+	cache, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer cache.Close()
+
+	cache.Set("https://example.com/a", &CachedResponse{Data: []byte("a")})
+	cache.Set("https://example.org/b", &CachedResponse{Data: []byte("b")})
+
+	if err := cache.PurgeAll(); err != nil {
+		t.Fatalf("failed to purge: %v", err)
+	}
+
+	for _, url := range []string{"https://example.com/a", "https://example.org/b"} {
+		if _, found, _ := cache.Get(url); found {
+			t.Errorf("expected %s to be purged", url)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package cache
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Entries are stored as a binary header followed by the raw, optionally
+// zstd-compressed body:
+//
+//	version  byte
+//	flags    byte
+//	status, content type, ETag, Last-Modified,
+//	stored at, expires at, stale windows, header fields
+//	vary     Vary fields and variant URLs, if flagVary is set
+//	body     the remaining bytes
+//
+// Integers are varints and strings are length-prefixed. Entries written
+// before the binary format are JSON objects, which never start with a
+// version byte, and are still read.
+const (
+	formatVersion1 byte = 1
+
+	flagZstd byte = 1 << 0
+	flagVary byte = 1 << 1
+)
+
+// minCompressSize is the smallest body worth compressing
+const minCompressSize = 1024
+
+var ErrCorruptEntry = errors.New("corrupt cache entry")
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// encodeEntry serializes an entry, compressing its body when requested and
+// worthwhile
+func encodeEntry(r *CachedResponse, compress bool) []byte {
+	buf := make([]byte, 0, 256+len(r.Data))
+	buf = append(buf, formatVersion1, 0)
+
+	buf = binary.AppendUvarint(buf, uint64(r.StatusCode))
+	buf = appendString(buf, r.ContentType)
+	buf = appendString(buf, r.ETag)
+	buf = appendString(buf, r.LastModified)
+	buf = binary.AppendVarint(buf, unixNano(r.StoredAt))
+	buf = binary.AppendVarint(buf, unixNano(r.ExpiresAt))
+	buf = binary.AppendVarint(buf, int64(r.StaleWhileRevalidate))
+	buf = binary.AppendVarint(buf, int64(r.StaleIfError))
+
+	buf = binary.AppendUvarint(buf, uint64(len(r.Header)))
+	for name, values := range r.Header {
+		buf = appendString(buf, name)
+		buf = binary.AppendUvarint(buf, uint64(len(values)))
+		for _, value := range values {
+			buf = appendString(buf, value)
+		}
+	}
+
+	if len(r.Vary) > 0 || len(r.Variants) > 0 {
+		buf[1] |= flagVary
+		buf = appendStrings(buf, r.Vary)
+		buf = appendStrings(buf, r.Variants)
+	}
+
+	// Bodies that already carry a content coding do not compress further
+	if compress && len(r.Data) >= minCompressSize && Compressible(r.ContentType) && r.Header.Get("Content-Encoding") == "" {
+		compressed := zstdEncoder.EncodeAll(r.Data, nil)
+		if len(compressed) < len(r.Data) {
+			buf[1] |= flagZstd
+			return append(buf, compressed...)
+		}
+	}
+	return append(buf, r.Data...)
+}
+
+// decodeEntry parses an entry in the binary or the legacy JSON format
+func decodeEntry(value []byte) (*CachedResponse, error) {
+	if len(value) == 0 {
+		return nil, ErrCorruptEntry
+	}
+
+	var r CachedResponse
+	if value[0] == '{' {
+		if err := json.Unmarshal(value, &r); err != nil {
+			return nil, err
+		}
+		return &r, nil
+	}
+	if value[0] != formatVersion1 || len(value) < 2 {
+		return nil, ErrCorruptEntry
+	}
+
+	d := decoder{buf: value[2:]}
+	r.StatusCode = int(d.uvarint())
+	r.ContentType = d.string()
+	r.ETag = d.string()
+	r.LastModified = d.string()
+	r.StoredAt = fromUnixNano(d.varint())
+	r.ExpiresAt = fromUnixNano(d.varint())
+	r.StaleWhileRevalidate = time.Duration(d.varint())
+	r.StaleIfError = time.Duration(d.varint())
+
+	if fields := d.uvarint(); fields > 0 && d.err == nil {
+		r.Header = make(http.Header, min(fields, 64))
+		for i := uint64(0); i < fields && d.err == nil; i++ {
+			name := d.string()
+			count := d.uvarint()
+			for j := uint64(0); j < count && d.err == nil; j++ {
+				r.Header[name] = append(r.Header[name], d.string())
+			}
+		}
+	}
+	if value[1]&flagVary != 0 {
+		r.Vary = d.strings()
+		r.Variants = d.strings()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if value[1]&flagZstd != 0 {
+		data, err := zstdDecoder.DecodeAll(d.buf, nil)
+		if err != nil {
+			return nil, ErrCorruptEntry
+		}
+		r.Data = data
+	} else {
+		r.Data = append([]byte(nil), d.buf...)
+	}
+	return &r, nil
+}
+
+// Compressible reports whether a content type is worth compressing
+func Compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/x-ndjson", "application/wasm", "image/svg+xml",
+		"application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendStrings(buf []byte, list []string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(list)))
+	for _, s := range list {
+		buf = appendString(buf, s)
+	}
+	return buf
+}
+
+// unixNano encodes a time, keeping the zero time distinct
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// decoder reads the binary header, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrCorruptEntry
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = ErrCorruptEntry
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if length > uint64(len(d.buf)) {
+		d.err = ErrCorruptEntry
+		return ""
+	}
+	s := string(d.buf[:length])
+	d.buf = d.buf[length:]
+	return s
+}
+
+func (d *decoder) strings() []string {
+	count := d.uvarint()
+	if count == 0 || d.err != nil {
+		return nil
+	}
+	list := make([]string, 0, min(count, 64))
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		list = append(list, d.string())
+	}
+	return list
+}
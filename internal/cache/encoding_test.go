@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+func TestEncoding_RoundTrip(t *testing.T) {
+	now := time.Unix(1_700_000_000, 123)
+	entry := &CachedResponse{
+		StatusCode:           http.StatusNotFound,
+		Data:                 []byte("not found"),
+		ContentType:          "text/plain",
+		Header:               http.Header{"Cache-Control": {"max-age=60"}, "Link": {"<a>", "<b>"}},
+		ETag:                 `"v1"`,
+		LastModified:         "Tue, 14 Nov 2023 22:13:20 GMT",
+		StoredAt:             now,
+		ExpiresAt:            now.Add(time.Minute),
+		StaleWhileRevalidate: time.Second,
+		StaleIfError:         time.Hour,
+		Vary:                 []string{"accept-language"},
+		Variants:             []string{"https://example.com/#vary.accept-language=en"},
+	}
+
+	decoded, err := decodeEntry(encodeEntry(entry, true))
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if !decoded.StoredAt.Equal(entry.StoredAt) || !decoded.ExpiresAt.Equal(entry.ExpiresAt) {
+		t.Errorf("timestamps changed: %v, %v", decoded.StoredAt, decoded.ExpiresAt)
+	}
+	decoded.StoredAt, decoded.ExpiresAt = entry.StoredAt, entry.ExpiresAt
+	if !reflect.DeepEqual(decoded, entry) {
+		t.Errorf("round trip changed the entry:\n got %+v\nwant %+v", decoded, entry)
+	}
+
+	// Zero times stay zero
+	decoded, _ = decodeEntry(encodeEntry(&CachedResponse{Data: []byte("x")}, false))
+	if !decoded.StoredAt.IsZero() || !decoded.ExpiresAt.IsZero() {
+		t.Error("expected zero timestamps to survive")
+	}
+}
+
+func TestEncoding_CompressesTextBodies(t *testing.T) {
+	text := bytes.Repeat([]byte(`{"key":"value"},`), 1000)
+
+	tests := []struct {
+		name        string
+		contentType string
+		data        []byte
+		compress    bool
+		want        bool
+	}{
+		{"json", "application/json; charset=utf-8", text, true, true},
+		{"disabled", "application/json", text, false, false},
+		{"image", "image/png", text, true, false},
+		{"small body", "text/plain", []byte("short"), true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := encodeEntry(&CachedResponse{Data: tt.data, ContentType: tt.contentType}, tt.compress)
+			if compressed := encoded[1]&flagZstd != 0; compressed != tt.want {
+				t.Errorf("compressed = %v, want %v", compressed, tt.want)
+			}
+			decoded, err := decodeEntry(encoded)
+			if err != nil || !bytes.Equal(decoded.Data, tt.data) {
+				t.Errorf("body did not survive: %v", err)
+			}
+		})
+	}
+}
+
+func TestEncoding_RejectsCorruptEntries(t *testing.T) {
+	encoded := encodeEntry(&CachedResponse{Data: []byte("data"), ContentType: "text/plain", ETag: `"v1"`}, false)
+
+	for _, value := range [][]byte{nil, {9, 0}, encoded[:5]} {
+		if _, err := decodeEntry(value); err == nil {
+			t.Errorf("expected %v to be rejected", value)
+		}
+	}
+}
+
+func TestCache_ReadsLegacyJSONEntries(t *testing.T) {
+	c, err := NewBadgerCache(t.TempDir(), time.Hour, WithCompression(true))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	// Written the way entries were stored before the binary format
+	legacy, _ := json.Marshal(&CachedResponse{
+		Data:        []byte("legacy"),
+		ContentType: "text/plain",
+		StoredAt:    time.Now(),
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+	c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(GenerateCacheKey("https://example.com/old")), legacy)
+	})
+
+	entry, found, err := c.Get("https://example.com/old")
+	if err != nil || !found {
+		t.Fatalf("expected the legacy entry, found=%v err=%v", found, err)
+	}
+	if string(entry.Data) != "legacy" || !entry.IsFresh(time.Now()) {
+		t.Errorf("unexpected legacy entry %+v", entry)
+	}
+	if entry.StoredSize != len(legacy) {
+		t.Errorf("expected stored size %d, got %d", len(legacy), entry.StoredSize)
+	}
+
+	// Rewriting it uses the binary format, compressed
+	body := bytes.Repeat([]byte("compressible "), 1000)
+	c.Set("https://example.com/old", &CachedResponse{Data: body, ContentType: "text/plain"})
+	entry, _, _ = c.Get("https://example.com/old")
+	if !bytes.Equal(entry.Data, body) {
+		t.Error("expected the new body")
+	}
+	if entry.StoredSize >= len(body)/2 {
+		t.Errorf("expected a compressed entry, stored %d bytes for %d", entry.StoredSize, len(body))
+	}
+}
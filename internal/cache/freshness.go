@@ -0,0 +1,175 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl holds the Cache-Control response directives a shared cache cares about
+type CacheControl struct {
+	NoStore        bool
+	NoCache        bool
+	Private        bool
+	Public         bool
+	MustRevalidate bool
+	MaxAge         time.Duration
+	HasMaxAge      bool
+	SMaxAge        time.Duration
+	HasSMaxAge     bool
+
+	// RFC 5861 extensions
+	StaleWhileRevalidate    time.Duration
+	HasStaleWhileRevalidate bool
+	StaleIfError            time.Duration
+	HasStaleIfError         bool
+}
+
+// ParseCacheControl parses a Cache-Control header value
+func ParseCacheControl(value string) CacheControl {
+	var cc CacheControl
+
+	for _, directive := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		arg = strings.Trim(strings.TrimSpace(arg), `"`)
+
+		switch name {
+		case "no-store":
+			cc.NoStore = true
+		case "no-cache":
+			cc.NoCache = true
+		case "private":
+			cc.Private = true
+		case "public":
+			cc.Public = true
+		case "must-revalidate":
+			cc.MustRevalidate = true
+		case "max-age":
+			if d, ok := parseDeltaSeconds(arg); ok {
+				cc.MaxAge, cc.HasMaxAge = d, true
+			}
+		case "s-maxage":
+			if d, ok := parseDeltaSeconds(arg); ok {
+				cc.SMaxAge, cc.HasSMaxAge = d, true
+			}
+		case "stale-while-revalidate":
+			if d, ok := parseDeltaSeconds(arg); ok {
+				cc.StaleWhileRevalidate, cc.HasStaleWhileRevalidate = d, true
+			}
+		case "stale-if-error":
+			if d, ok := parseDeltaSeconds(arg); ok {
+				cc.StaleIfError, cc.HasStaleIfError = d, true
+			}
+		}
+	}
+
+	return cc
+}
+
+// IsStorable reports whether a shared cache may store the response at all
+func IsStorable(h http.Header) bool {
+	cc := ParseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	return !cc.NoStore && !cc.Private
+}
+
+// AllowsAuthorized reports whether a response to a request carrying
+// credentials may be stored in a shared cache (RFC 9111 section 3.5)
+func AllowsAuthorized(h http.Header) bool {
+	cc := ParseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	return cc.Public || cc.HasSMaxAge || cc.MustRevalidate
+}
+
+// StaleWindows returns how long a response may be served stale while it
+// is revalidated in the background and when upstream fails, using the
+// upstream Cache-Control extensions if present and the given defaults
+// otherwise. Responses that must be revalidated are never served stale.
+func StaleWindows(h http.Header, whileRevalidate, ifError time.Duration) (time.Duration, time.Duration) {
+	cc := ParseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	if cc.MustRevalidate || cc.NoCache {
+		return 0, 0
+	}
+	if cc.HasStaleWhileRevalidate {
+		whileRevalidate = cc.StaleWhileRevalidate
+	}
+	if cc.HasStaleIfError {
+		ifError = cc.StaleIfError
+	}
+	return whileRevalidate, ifError
+}
+
+// FreshnessLifetime computes how long a response may still be served from a
+// shared cache without revalidation, following RFC 9111. It returns ok=false
+// when the response is not fresh or must not be stored. A zero duration with
+// ok=true means upstream gave no explicit freshness information and the
+// cache default applies.
+func FreshnessLifetime(h http.Header, now time.Time) (time.Duration, bool) {
+	cc := ParseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	if cc.NoStore || cc.NoCache || cc.Private {
+		return 0, false
+	}
+
+	date := now
+	if d, err := http.ParseTime(h.Get("Date")); err == nil {
+		date = d
+	}
+
+	var lifetime time.Duration
+	switch {
+	case cc.HasSMaxAge:
+		lifetime = cc.SMaxAge
+	case cc.HasMaxAge:
+		lifetime = cc.MaxAge
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			// Invalid Expires values such as "0" mean already expired
+			return 0, false
+		}
+		lifetime = expires.Sub(date)
+	default:
+		return 0, true
+	}
+
+	remaining := lifetime - currentAge(h, date, now)
+	if remaining <= 0 {
+		return 0, false
+	}
+	return remaining, true
+}
+
+// currentAge estimates the response age from the Age and Date headers
+func currentAge(h http.Header, date, now time.Time) time.Duration {
+	age := now.Sub(date).Truncate(time.Second)
+	if age < 0 {
+		age = 0
+	}
+	if headerAge, ok := parseDeltaSeconds(h.Get("Age")); ok && headerAge > age {
+		age = headerAge
+	}
+	return age
+}
+
+// maxDeltaSeconds caps delta-seconds values as recommended by RFC 9111
+const maxDeltaSeconds = 1<<31 - 1
+
+// parseDeltaSeconds parses a non-negative number of seconds
+func parseDeltaSeconds(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if errors.Is(err, strconv.ErrRange) && value[0] != '-' {
+		seconds = maxDeltaSeconds
+	} else if err != nil || seconds < 0 {
+		return 0, false
+	}
+
+	if seconds > maxDeltaSeconds {
+		seconds = maxDeltaSeconds
+	}
+	return time.Duration(seconds) * time.Second, true
+}
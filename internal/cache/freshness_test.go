@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+
+	tests := []struct {
+		name      string
+		header    http.Header
+		wantTTL   time.Duration
+		wantStore bool
+	}{
+		{"no freshness info", http.Header{}, 0, true},
+		{"max-age", http.Header{"Cache-Control": {"max-age=5"}}, 5 * time.Second, true},
+		{"s-maxage overrides max-age", http.Header{"Cache-Control": {"max-age=5, s-maxage=30"}}, 30 * time.Second, true},
+		{"max-age overrides expires", http.Header{
+			"Cache-Control": {"max-age=10"},
+			"Date":          {date},
+			"Expires":       {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, 10 * time.Second, true},
+		{"expires relative to date", http.Header{
+			"Date":    {date},
+			"Expires": {now.Add(time.Minute).Format(http.TimeFormat)},
+		}, time.Minute, true},
+		{"age reduces lifetime", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"15"}}, 45 * time.Second, true},
+		{"older date reduces lifetime", http.Header{
+			"Cache-Control": {"max-age=60"},
+			"Date":          {now.Add(-20 * time.Second).Format(http.TimeFormat)},
+		}, 40 * time.Second, true},
+		{"stale on arrival", http.Header{"Cache-Control": {"max-age=10"}, "Age": {"20"}}, 0, false},
+		{"max-age zero", http.Header{"Cache-Control": {"max-age=0"}}, 0, false},
+		{"no-store", http.Header{"Cache-Control": {"no-store, max-age=60"}}, 0, false},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, 0, false},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{"invalid expires", http.Header{"Expires": {"0"}}, 0, false},
+		{"quoted and mixed case", http.Header{"Cache-Control": {`Public, MAX-AGE="120"`}}, 120 * time.Second, true},
+		{"multiple header lines", http.Header{"Cache-Control": {"public", "max-age=30"}}, 30 * time.Second, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ttl, store := FreshnessLifetime(tt.header, now)
+			if store != tt.wantStore {
+				t.Errorf("storable = %v, want %v", store, tt.wantStore)
+			}
+			if ttl != tt.wantTTL {
+				t.Errorf("ttl = %v, want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestStaleWindows(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantRevalid  time.Duration
+		wantOnError  time.Duration
+	}{
+		{"defaults", "max-age=60", time.Minute, time.Hour},
+		{"upstream extensions", "max-age=60, stale-while-revalidate=30, stale-if-error=600", 30 * time.Second, 10 * time.Minute},
+		{"upstream disables", "max-age=60, stale-while-revalidate=0", 0, time.Hour},
+		{"must-revalidate", "max-age=60, must-revalidate, stale-if-error=600", 0, 0},
+		{"no-cache", "no-cache", 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Cache-Control": {tt.cacheControl}}
+			revalidate, onError := StaleWindows(header, time.Minute, time.Hour)
+			if revalidate != tt.wantRevalid || onError != tt.wantOnError {
+				t.Errorf("got %v, %v, want %v, %v", revalidate, onError, tt.wantRevalid, tt.wantOnError)
+			}
+		})
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	cc := ParseCacheControl("no-cache, max-age=abc, s-maxage=-1, private")
+
+	if !cc.NoCache || !cc.Private {
+		t.Errorf("expected no-cache and private, got %+v", cc)
+	}
+	if cc.HasMaxAge || cc.HasSMaxAge {
+		t.Errorf("invalid delta-seconds should be ignored, got %+v", cc)
+	}
+
+	cc = ParseCacheControl("max-age=99999999999999999999")
+	if !cc.HasMaxAge || cc.MaxAge != maxDeltaSeconds*time.Second {
+		t.Errorf("overflowing max-age should be capped, got %+v", cc)
+	}
+}
@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// DefaultStripParams are the query parameters dropped from cache keys by
+// default: campaign and click tracking, and jQuery's "_" cache-buster
+var DefaultStripParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "_"}
+
+// KeyNormalizer turns target URLs into canonical cache keys, so that URLs
+// that only differ in spelling share an entry
+type KeyNormalizer struct {
+	strip    map[string]bool
+	prefixes []string
+}
+
+// NewKeyNormalizer creates a normalizer that drops the given query
+// parameters. A trailing "*" matches every parameter with that prefix.
+func NewKeyNormalizer(stripParams []string) *KeyNormalizer {
+	n := &KeyNormalizer{strip: make(map[string]bool)}
+	for _, param := range stripParams {
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			n.prefixes = append(n.prefixes, prefix)
+		} else {
+			n.strip[param] = true
+		}
+	}
+	return n
+}
+
+// Normalize returns the canonical form of a URL: lowercase scheme and
+// host, no default port, no fragment, consistent percent-encoding and
+// query parameters sorted by name without the stripped ones. URLs that do not
+// parse are returned unchanged.
+func (n *KeyNormalizer) Normalize(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if port := u.Port(); (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme)
+	b.WriteString("://")
+	if u.User != nil {
+		b.WriteString(u.User.String())
+		b.WriteByte('@')
+	}
+	b.WriteString(host)
+
+	path := normalizeEscapes(u.EscapedPath())
+	if path == "" {
+		path = "/"
+	}
+	b.WriteString(path)
+
+	if query := n.normalizeQuery(u.RawQuery); query != "" {
+		b.WriteByte('?')
+		b.WriteString(query)
+	}
+	return b.String()
+}
+
+// NormalizePrefix normalizes the scheme, host and path escapes of a URL
+// prefix the way Normalize does, so it matches normalized keys. The query
+// is left as given; it may be cut off anywhere.
+func (n *KeyNormalizer) NormalizePrefix(prefix string) string {
+	scheme, rest, ok := strings.Cut(prefix, "://")
+	if !ok {
+		return prefix
+	}
+	scheme = strings.ToLower(scheme)
+
+	host, path, hasPath := strings.Cut(rest, "/")
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[:at+1] + strings.ToLower(host[at+1:])
+	} else {
+		host = strings.ToLower(host)
+	}
+	// The port is only known to be complete once the path starts
+	if hasPath {
+		if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+			host = host[:strings.LastIndex(host, ":")]
+		}
+		path, query, hasQuery := strings.Cut(path, "?")
+		path = normalizeEscapes(path)
+		if hasQuery {
+			path += "?" + query
+		}
+		return scheme + "://" + host + "/" + path
+	}
+	return scheme + "://" + host
+}
+
+// normalizeQuery sorts the parameters of a raw query and drops stripped ones
+func (n *KeyNormalizer) normalizeQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && n.strips(unescaped) {
+			continue
+		}
+		params = append(params, normalizeEscapes(param))
+	}
+	// Repeated parameters keep their order, which upstream may rely on
+	sort.SliceStable(params, func(i, j int) bool {
+		return paramName(params[i]) < paramName(params[j])
+	})
+	return strings.Join(params, "&")
+}
+
+// paramName returns the name of a "name=value" query parameter
+func paramName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	return name
+}
+
+// strips reports whether a query parameter is left out of keys
+func (n *KeyNormalizer) strips(name string) bool {
+	if n.strip[name] {
+		return true
+	}
+	for _, prefix := range n.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeEscapes decodes percent-encoded unreserved characters and
+// uppercases the hex digits of the remaining escapes (RFC 3986 section 6.2.2)
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteString(strings.ToUpper(s[i+1 : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
@@ -0,0 +1,69 @@
+package cache
+
+import "testing"
+
+func TestKeyNormalizer_Normalize(t *testing.T) {
+	n := NewKeyNormalizer(DefaultStripParams)
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"scheme and host case", "HTTPS://Example.COM/Path", "https://example.com/Path"},
+		{"default http port", "http://example.com:80/a", "http://example.com/a"},
+		{"default https port", "https://example.com:443/a", "https://example.com/a"},
+		{"other port kept", "https://example.com:8443/a", "https://example.com:8443/a"},
+		{"empty path", "https://example.com", "https://example.com/"},
+		{"fragment dropped", "https://example.com/a#top", "https://example.com/a"},
+		{"sorted query", "https://example.com/?b=2&a=1&a=0", "https://example.com/?a=1&a=0&b=2"},
+		{"repeated params keep their order", "https://example.com/?a=2&a=1", "https://example.com/?a=2&a=1"},
+		{"tracking stripped", "https://example.com/?utm_source=x&id=1&fbclid=y&utm_medium=z", "https://example.com/?id=1"},
+		{"cache-buster stripped", "https://example.com/data?_=1700000000", "https://example.com/data"},
+		{"only stripped params", "https://example.com/?gclid=1", "https://example.com/"},
+		{"unreserved escapes decoded", "https://example.com/%7Euser/%61bc", "https://example.com/~user/abc"},
+		{"reserved escapes uppercased", "https://example.com/a%2fb?q=%e2%82%ac", "https://example.com/a%2Fb?q=%E2%82%AC"},
+		{"empty params dropped", "https://example.com/?a=1&&b=2&", "https://example.com/?a=1&b=2"},
+		{"unparseable kept", "://nope", "://nope"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := n.Normalize(tt.url); got != tt.want {
+				t.Errorf("Normalize(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyNormalizer_StripsConfiguredParams(t *testing.T) {
+	n := NewKeyNormalizer([]string{"cb", "ref_*"})
+
+	got := n.Normalize("https://example.com/?cb=1&ref_src=a&utm_source=b&Cb=2")
+	if want := "https://example.com/?Cb=2&utm_source=b"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Encoded parameter names are matched after decoding
+	got = n.Normalize("https://example.com/?%63b=1&x=1")
+	if want := "https://example.com/?x=1"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestKeyNormalizer_NormalizePrefix(t *testing.T) {
+	n := NewKeyNormalizer(DefaultStripParams)
+
+	tests := map[string]string{
+		"HTTPS://API.Example.com:443/v1/%7Eusers": "https://api.example.com/v1/~users",
+		"https://Example.com:443":                 "https://example.com:443",
+		"http://Example.com:8080/a?B=1&a":         "http://example.com:8080/a?B=1&a",
+		"https://Example.c":                       "https://example.c",
+		"not a url":                               "not a url",
+	}
+	for prefix, want := range tests {
+		if got := n.NormalizePrefix(prefix); got != want {
+			t.Errorf("NormalizePrefix(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TieredCache keeps recently used entries in memory in front of a
+// BadgerCache. Reads are served from memory when possible, writes go to
+// both tiers and deletes and purges remove from both.
+type TieredCache struct {
+	disk *BadgerCache
+	hot  *lru
+
+	// writeMu orders writes so memory never holds an entry the disk no
+	// longer has
+	writeMu sync.Mutex
+
+	memoryHits atomic.Int64
+	diskHits   atomic.Int64
+	misses     atomic.Int64
+}
+
+// TierStats counts lookups per tier and describes the memory tier
+type TierStats struct {
+	MemoryHits    int64 `json:"memory_hits"`
+	DiskHits      int64 `json:"disk_hits"`
+	Misses        int64 `json:"misses"`
+	MemoryEntries int   `json:"memory_entries"`
+	MemoryBytes   int64 `json:"memory_bytes"`
+}
+
+// NewTieredCache puts an in-memory LRU tier of at most maxBytes in front of
+// disk
+func NewTieredCache(disk *BadgerCache, maxBytes int64) *TieredCache {
+	c := &TieredCache{
+		disk: disk,
+		hot:  newLRU(maxBytes),
+	}
+	disk.onEvict(func(urls []string) {
+		for _, url := range urls {
+			c.hot.remove(url)
+		}
+	})
+	return c
+}
+
+// Get returns an entry from memory, or from disk, promoting it to memory
+func (c *TieredCache) Get(url string) (*CachedResponse, bool, error) {
+	entry, tier, err := c.lookup(url)
+	c.count(tier)
+	return entry, tier != tierNone, err
+}
+
+// Peek returns an entry like Get without counting it in the tier stats,
+// for copies derived from an entry whose lookup was already counted
+func (c *TieredCache) Peek(url string) (*CachedResponse, bool, error) {
+	entry, tier, err := c.lookup(url)
+	return entry, tier != tierNone, err
+}
+
+// Tiers a lookup can be answered from
+const (
+	tierNone = iota
+	tierMemory
+	tierDisk
+)
+
+// lookup finds an entry without counting it in the tier stats, promoting
+// disk hits to memory
+func (c *TieredCache) lookup(url string) (*CachedResponse, int, error) {
+	if entry, ok := c.hot.get(url, time.Now()); ok {
+		c.disk.touch(url)
+		return entry, tierMemory, nil
+	}
+
+	generation := c.hot.generation()
+	entry, retainUntil, found, err := c.disk.get(url)
+	if err != nil || !found {
+		return nil, tierNone, err
+	}
+
+	// Skip promotion if a write raced with the disk read
+	c.hot.addIfUnchanged(generation, url, entry, retainUntil)
+	return entry, tierDisk, nil
+}
+
+// count records the outcome of one lookup in the tier stats
+func (c *TieredCache) count(tier int) {
+	switch tier {
+	case tierMemory:
+		c.memoryHits.Add(1)
+	case tierDisk:
+		c.diskHits.Add(1)
+	default:
+		c.misses.Add(1)
+	}
+}
+
+// Set writes an entry to disk and memory
+func (c *TieredCache) Set(url string, response *CachedResponse) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	stored, retainUntil, err := c.disk.set(url, response)
+	if err != nil {
+		c.hot.remove(url)
+		return err
+	}
+	if stored == nil {
+		c.hot.remove(url)
+		return nil
+	}
+	c.hot.add(url, stored, retainUntil)
+	return nil
+}
+
+// Delete removes an entry from both tiers
+func (c *TieredCache) Delete(url string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.hot.remove(url)
+	return c.disk.Delete(url)
+}
+
+// PurgePrefix removes every entry whose URL starts with prefix from both tiers
+func (c *TieredCache) PurgePrefix(prefix string) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.hot.removeMatching(func(url string) bool { return strings.HasPrefix(url, prefix) })
+	return c.disk.PurgePrefix(prefix)
+}
+
+// PurgeHost removes every entry for a hostname from both tiers
+func (c *TieredCache) PurgeHost(host string) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	host = strings.ToLower(host)
+	c.hot.removeMatching(func(url string) bool { return hostOf(url) == host })
+	return c.disk.PurgeHost(host)
+}
+
+// PurgeAll removes every entry from both tiers
+func (c *TieredCache) PurgeAll() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.hot.removeMatching(func(string) bool { return true })
+	return c.disk.PurgeAll()
+}
+
+// TierStats returns lookup counts and the memory tier's size
+func (c *TieredCache) TierStats() TierStats {
+	entries, bytes := c.hot.size()
+	return TierStats{
+		MemoryHits:    c.memoryHits.Load(),
+		DiskHits:      c.diskHits.Load(),
+		Misses:        c.misses.Load(),
+		MemoryEntries: entries,
+		MemoryBytes:   bytes,
+	}
+}
+
+// Stats returns the disk tier's BadgerDB statistics
+func (c *TieredCache) Stats() Stats {
+	return c.disk.Stats()
+}
+
+// QuotaStats returns the disk tier's quota state
+func (c *TieredCache) QuotaStats() QuotaStats {
+	return c.disk.QuotaStats()
+}
+
+// Close closes the disk tier
+func (c *TieredCache) Close() error {
+	return c.disk.Close()
+}
+
+// clone copies an entry so callers may modify its header
+func (r *CachedResponse) clone() *CachedResponse {
+	copied := *r
+	copied.Header = r.Header.Clone()
+	return &copied
+}
+
+// lru is a byte-bounded least recently used set of entries
+type lru struct {
+	maxBytes int64
+
+	mu      sync.Mutex
+	bytes   int64
+	gen     uint64
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+type lruItem struct {
+	url         string
+	entry       *CachedResponse
+	retainUntil time.Time
+	size        int64
+}
+
+func newLRU(maxBytes int64) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of an entry that the disk tier would still hold
+func (l *lru) get(url string, now time.Time) (*CachedResponse, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.entries[url]
+	if !ok {
+		return nil, false
+	}
+	item := elem.Value.(*lruItem)
+	if !now.Before(item.retainUntil) {
+		l.removeElement(elem)
+		return nil, false
+	}
+	l.order.MoveToFront(elem)
+	return item.entry.clone(), true
+}
+
+// generation changes whenever an entry is written or removed
+func (l *lru) generation() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.gen
+}
+
+// add stores an entry, evicting the least recently used ones over budget
+func (l *lru) add(url string, entry *CachedResponse, retainUntil time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.gen++
+	l.addLocked(url, entry, retainUntil)
+}
+
+// addIfUnchanged adds an entry unless the generation moved on
+func (l *lru) addIfUnchanged(generation uint64, url string, entry *CachedResponse, retainUntil time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.gen == generation {
+		l.addLocked(url, entry, retainUntil)
+	}
+}
+
+func (l *lru) addLocked(url string, entry *CachedResponse, retainUntil time.Time) {
+	if elem, ok := l.entries[url]; ok {
+		l.removeElement(elem)
+	}
+
+	size := entrySize(url, entry)
+	if size > l.maxBytes {
+		return
+	}
+	l.entries[url] = l.order.PushFront(&lruItem{
+		url:         url,
+		entry:       entry.clone(),
+		retainUntil: retainUntil,
+		size:        size,
+	})
+	l.bytes += size
+
+	for l.bytes > l.maxBytes {
+		l.removeElement(l.order.Back())
+	}
+}
+
+// remove drops an entry
+func (l *lru) remove(url string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.gen++
+	if elem, ok := l.entries[url]; ok {
+		l.removeElement(elem)
+	}
+}
+
+// removeMatching drops every entry whose URL matches
+func (l *lru) removeMatching(match func(url string) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.gen++
+	for url, elem := range l.entries {
+		if match(url) {
+			l.removeElement(elem)
+		}
+	}
+}
+
+// size returns the number of entries and their approximate size
+func (l *lru) size() (int, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries), l.bytes
+}
+
+func (l *lru) removeElement(elem *list.Element) {
+	item := l.order.Remove(elem).(*lruItem)
+	delete(l.entries, item.url)
+	l.bytes -= item.size
+}
+
+// entryOverhead approximates the fixed memory cost of an entry
+const entryOverhead = 256
+
+// entrySize approximates the memory an entry occupies
+func entrySize(url string, entry *CachedResponse) int64 {
+	size := int64(entryOverhead + len(url) + len(entry.Data) + len(entry.ContentType) + len(entry.ETag) + len(entry.LastModified))
+	for name, values := range entry.Header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func newTestTieredCache(t *testing.T, maxBytes int64) *TieredCache {
+	t.Helper()
+
+	disk, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	c := NewTieredCache(disk, maxBytes)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestTieredCache_ServesFromMemory(t *testing.T) {
+	c := newTestTieredCache(t, 1<<20)
+
+	if err := c.Set("https://example.com/a", &CachedResponse{Data: []byte("a")}); err != nil {
+		t.Fatalf("failed to set: %v", err)
+	}
+	entry, found, err := c.Get("https://example.com/a")
+	if err != nil || !found || string(entry.Data) != "a" {
+		t.Fatalf("unexpected result %v %v %v", entry, found, err)
+	}
+
+	// Entries only on disk are promoted on first read
+	c.disk.Set("https://example.com/b", &CachedResponse{Data: []byte("b")})
+	c.Get("https://example.com/b")
+	c.Get("https://example.com/b")
+	c.Get("https://example.com/missing")
+
+	stats := c.TierStats()
+	if stats.MemoryHits != 2 || stats.DiskHits != 1 || stats.Misses != 1 {
+		t.Errorf("unexpected lookups %+v", stats)
+	}
+	if stats.MemoryEntries != 2 {
+		t.Errorf("expected 2 entries in memory, got %d", stats.MemoryEntries)
+	}
+}
+
+func TestTieredCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1000)
+	c := newTestTieredCache(t, 3*(entryOverhead+1100))
+
+	for _, path := range []string{"a", "b", "c"} {
+		c.Set("https://example.com/"+path, &CachedResponse{Data: body})
+	}
+	// Touch a so that b is the least recently used
+	c.Get("https://example.com/a")
+	c.Set("https://example.com/d", &CachedResponse{Data: body})
+
+	if _, ok := c.hot.get("https://example.com/b", time.Now()); ok {
+		t.Error("expected b to be evicted from memory")
+	}
+	for _, path := range []string{"a", "c", "d"} {
+		if _, ok := c.hot.get("https://example.com/"+path, time.Now()); !ok {
+			t.Errorf("expected %s in memory", path)
+		}
+	}
+	if _, bytes := c.hot.size(); bytes > c.hot.maxBytes {
+		t.Errorf("memory tier over budget: %d bytes", bytes)
+	}
+
+	// Evicted entries are still on disk
+	if _, found, _ := c.Get("https://example.com/b"); !found {
+		t.Error("expected b to be served from disk")
+	}
+}
+
+func TestTieredCache_InvalidatesBothTiers(t *testing.T) {
+	c := newTestTieredCache(t, 1<<20)
+	for _, url := range []string{"https://a.example.com/1", "https://a.example.com/2", "https://b.example.com/1", "https://c.example.com/1"} {
+		c.Set(url, &CachedResponse{Data: []byte("data")})
+	}
+
+	c.Delete("https://a.example.com/1")
+	if _, err := c.PurgePrefix("https://a.example.com/"); err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+	if _, err := c.PurgeHost("B.example.com"); err != nil {
+		t.Fatalf("purge failed: %v", err)
+	}
+
+	for _, url := range []string{"https://a.example.com/1", "https://a.example.com/2", "https://b.example.com/1"} {
+		if _, found, _ := c.Get(url); found {
+			t.Errorf("expected %s to be gone", url)
+		}
+	}
+	if _, found, _ := c.Get("https://c.example.com/1"); !found {
+		t.Error("expected unrelated entries to remain")
+	}
+
+	c.PurgeAll()
+	if entries, _ := c.hot.size(); entries != 0 {
+		t.Errorf("expected an empty memory tier, got %d entries", entries)
+	}
+	if _, found, _ := c.Get("https://c.example.com/1"); found {
+		t.Error("expected every entry to be gone")
+	}
+}
+
+func TestTieredCache_ReturnsCopies(t *testing.T) {
+	c := newTestTieredCache(t, 1<<20)
+	c.Set("https://example.com/", &CachedResponse{Data: []byte("data"), Header: map[string][]string{"X-A": {"1"}}})
+
+	entry, _, _ := c.Get("https://example.com/")
+	entry.Header.Set("X-A", "changed")
+
+	entry, _, _ = c.Get("https://example.com/")
+	if got := entry.Header.Get("X-A"); got != "1" {
+		t.Errorf("expected the stored header to be unchanged, got %q", got)
+	}
+}
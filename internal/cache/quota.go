@@ -0,0 +1,391 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// EvictionPolicy decides which entries go first when the cache is over quota
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently read entries
+	EvictLRU EvictionPolicy = "lru"
+	// EvictOldest evicts the entries stored longest ago
+	EvictOldest EvictionPolicy = "oldest"
+)
+
+// ParseEvictionPolicy validates a policy name
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch policy := EvictionPolicy(strings.ToLower(name)); policy {
+	case EvictLRU, EvictOldest:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown eviction policy %q: use %q or %q", name, EvictLRU, EvictOldest)
+}
+
+// evictionTarget is the share of the quota eviction frees down to, so it
+// does not run again on the next write
+const evictionTarget = 0.9
+
+// gcDiscardRatio rewrites value log files that are at least half garbage
+const gcDiscardRatio = 0.5
+
+// diskFullRetry is how often one write is let through to find out whether
+// a full disk has space again
+const diskFullRetry = time.Minute
+
+// QuotaStats describes the disk quota and maintenance of the cache. Usage
+// is only measured to enforce a quota, so UsedBytes and Entries are nil
+// without one.
+type QuotaStats struct {
+	MaxBytes      int64          `json:"max_bytes"`
+	UsedBytes     *int64         `json:"used_bytes,omitempty"`
+	Entries       *int           `json:"entries,omitempty"`
+	Policy        EvictionPolicy `json:"policy,omitempty"`
+	Evictions     int64          `json:"evictions"`
+	RefusedWrites int64          `json:"refused_writes"`
+	DiskFull      bool           `json:"disk_full"`
+	LastEviction  time.Time      `json:"last_eviction,omitzero"`
+	LastGC        time.Time      `json:"last_gc,omitzero"`
+}
+
+// quota tracks usage against the configured maximum size
+type quota struct {
+	maxBytes int64
+	policy   EvictionPolicy
+	interval time.Duration
+
+	// used is an estimate between scans: the last scan plus later writes
+	used     atomic.Int64
+	entries  atomic.Int64
+	written  atomic.Int64
+	evicted  atomic.Int64
+	refused  atomic.Int64
+	diskFull atomic.Bool
+	// fullSince is when the disk was last found full, in Unix nanoseconds
+	fullSince atomic.Int64
+
+	// enforcing serializes quota checks
+	enforcing sync.Mutex
+
+	mu           sync.Mutex
+	lastUsed     map[string]time.Time
+	lastEviction time.Time
+	lastGC       time.Time
+
+	// onEvict is told which URLs eviction removed; guarded by mu
+	onEvict func(urls []string)
+
+	trigger chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// WithMaxSize caps the stored size of all entries at maxBytes. Once it is
+// exceeded, entries are evicted by policy. The size counts encoded entries;
+// the directory itself is larger until compaction and value log GC catch up.
+func WithMaxSize(maxBytes int64, policy EvictionPolicy) Option {
+	return func(c *BadgerCache) {
+		c.quota.maxBytes = maxBytes
+		c.quota.policy = policy
+	}
+}
+
+// WithMaintenanceInterval runs value log GC and the quota check every d
+func WithMaintenanceInterval(d time.Duration) Option {
+	return func(c *BadgerCache) {
+		c.quota.interval = d
+	}
+}
+
+// indexValue records an entry's size and age in its URL index key
+func indexValue(size int, storedAt time.Time) []byte {
+	buf := []byte{formatVersion1}
+	buf = binary.AppendUvarint(buf, uint64(size))
+	return binary.AppendVarint(buf, storedAt.UnixNano())
+}
+
+// parseIndexValue reads an index value. Older index keys hold the hex
+// entry key instead, and count as empty and as old as possible.
+func parseIndexValue(value []byte) (int64, time.Time) {
+	if len(value) == 0 || value[0] != formatVersion1 {
+		return 0, time.Time{}
+	}
+	size, n := binary.Uvarint(value[1:])
+	if n <= 0 {
+		return 0, time.Time{}
+	}
+	storedAt, m := binary.Varint(value[1+n:])
+	if m <= 0 {
+		return 0, time.Time{}
+	}
+	return int64(size), time.Unix(0, storedAt)
+}
+
+// startMaintenance measures usage and starts the background loop
+func (c *BadgerCache) startMaintenance() error {
+	q := &c.quota
+	q.lastUsed = make(map[string]time.Time)
+	q.trigger = make(chan struct{}, 1)
+	q.stop = make(chan struct{})
+	q.done = make(chan struct{})
+
+	if q.maxBytes > 0 {
+		if _, err := c.enforceQuota(); err != nil {
+			return err
+		}
+	}
+	if q.interval <= 0 && q.maxBytes <= 0 {
+		close(q.done)
+		return nil
+	}
+	go c.maintain()
+	return nil
+}
+
+// maintain runs value log GC and the quota check until the cache closes
+func (c *BadgerCache) maintain() {
+	q := &c.quota
+	defer close(q.done)
+
+	var tick <-chan time.Time
+	if q.interval > 0 {
+		ticker := time.NewTicker(q.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.trigger:
+			if q.maxBytes > 0 {
+				c.enforceQuota()
+			}
+		case <-tick:
+			if q.maxBytes > 0 {
+				c.enforceQuota()
+			}
+			c.collectGarbage()
+		}
+	}
+}
+
+// stopMaintenance ends the background loop
+func (c *BadgerCache) stopMaintenance() {
+	if c.quota.stop == nil {
+		return
+	}
+	close(c.quota.stop)
+	<-c.quota.done
+}
+
+// collectGarbage rewrites value log files until none has enough garbage
+func (c *BadgerCache) collectGarbage() {
+	for {
+		if err := c.db.RunValueLogGC(gcDiscardRatio); err != nil {
+			break
+		}
+	}
+
+	c.quota.mu.Lock()
+	c.quota.lastGC = time.Now()
+	c.quota.mu.Unlock()
+	c.quota.diskFull.Store(false)
+}
+
+// noteWrite adds a stored entry to the usage estimate and asks for a
+// quota check once a tenth of the quota has been written since the last
+func (c *BadgerCache) noteWrite(size int) {
+	q := &c.quota
+	if q.maxBytes <= 0 {
+		return
+	}
+	q.used.Add(int64(size))
+	if q.written.Add(int64(size)) < q.maxBytes/10 && q.used.Load() <= q.maxBytes {
+		return
+	}
+	select {
+	case q.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// onEvict registers a function told about the URLs eviction removes
+func (c *BadgerCache) onEvict(fn func(urls []string)) {
+	c.quota.mu.Lock()
+	c.quota.onEvict = fn
+	c.quota.mu.Unlock()
+}
+
+// touch records a read for least-recently-used eviction
+func (c *BadgerCache) touch(url string) {
+	q := &c.quota
+	if q.maxBytes <= 0 || q.policy != EvictLRU {
+		return
+	}
+	q.mu.Lock()
+	q.lastUsed[url] = time.Now()
+	q.mu.Unlock()
+}
+
+// refuseWrite reports whether a failed write ran out of disk space. The
+// cache then stops writing until entries are deleted, maintenance has
+// freed space or a retried write succeeds.
+func (c *BadgerCache) refuseWrite(err error) bool {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return false
+	}
+	c.quota.fullSince.Store(time.Now().UnixNano())
+	c.quota.diskFull.Store(true)
+	c.quota.refused.Add(1)
+	return true
+}
+
+// refusing reports whether a write should be skipped because the disk is
+// full. Every diskFullRetry one write is tried anyway, in case space was
+// freed outside the cache.
+func (q *quota) refusing(now time.Time) bool {
+	if !q.diskFull.Load() {
+		return false
+	}
+	since := q.fullSince.Load()
+	if now.UnixNano()-since < int64(diskFullRetry) {
+		return true
+	}
+	return !q.fullSince.CompareAndSwap(since, now.UnixNano())
+}
+
+// quotaEntry is a candidate for eviction
+type quotaEntry struct {
+	url      string
+	size     int64
+	lastUsed time.Time
+}
+
+// enforceQuota measures the stored entries and evicts by policy while they
+// exceed the quota. It returns how many entries were evicted.
+func (c *BadgerCache) enforceQuota() (int, error) {
+	q := &c.quota
+	q.enforcing.Lock()
+	defer q.enforcing.Unlock()
+	q.written.Store(0)
+
+	var entries []quotaEntry
+	var used int64
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(urlIndexPrefix)
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			var size int64
+			var storedAt time.Time
+			if err := item.Value(func(val []byte) error {
+				size, storedAt = parseIndexValue(val)
+				return nil
+			}); err != nil {
+				return err
+			}
+			entries = append(entries, quotaEntry{
+				url:      strings.TrimPrefix(string(item.Key()), urlIndexPrefix),
+				size:     size,
+				lastUsed: storedAt,
+			})
+			used += size
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Reads are only known since startup; older entries count by age
+	q.mu.Lock()
+	live := make(map[string]time.Time, len(q.lastUsed))
+	for i := range entries {
+		if read, ok := q.lastUsed[entries[i].url]; ok {
+			live[entries[i].url] = read
+			if q.policy == EvictLRU && read.After(entries[i].lastUsed) {
+				entries[i].lastUsed = read
+			}
+		}
+	}
+	q.lastUsed = live
+	q.mu.Unlock()
+
+	if used <= q.maxBytes {
+		q.used.Store(used)
+		q.entries.Store(int64(len(entries)))
+		return 0, nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+	target := int64(float64(q.maxBytes) * evictionTarget)
+	var victims []string
+	for _, entry := range entries {
+		if used <= target {
+			break
+		}
+		victims = append(victims, entry.url)
+		used -= entry.size
+	}
+	if err := c.deleteURLs(victims); err != nil {
+		return 0, err
+	}
+
+	q.used.Store(used)
+	q.entries.Store(int64(len(entries) - len(victims)))
+	q.evicted.Add(int64(len(victims)))
+	q.mu.Lock()
+	q.lastEviction = time.Now()
+	for _, url := range victims {
+		delete(q.lastUsed, url)
+	}
+	onEvict := q.onEvict
+	q.mu.Unlock()
+	if onEvict != nil {
+		onEvict(victims)
+	}
+
+	// Reclaim the space right away
+	c.collectGarbage()
+	return len(victims), nil
+}
+
+// QuotaStats returns the quota's current state
+func (c *BadgerCache) QuotaStats() QuotaStats {
+	q := &c.quota
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	stats := QuotaStats{
+		MaxBytes:      q.maxBytes,
+		Policy:        q.policy,
+		Evictions:     q.evicted.Load(),
+		RefusedWrites: q.refused.Load(),
+		DiskFull:      q.diskFull.Load(),
+		LastEviction:  q.lastEviction,
+		LastGC:        q.lastGC,
+	}
+	if q.maxBytes > 0 {
+		used, entries := q.used.Load(), int(q.entries.Load())
+		stats.UsedBytes, stats.Entries = &used, &entries
+	}
+	return stats
+}
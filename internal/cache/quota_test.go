@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for name, want := range map[string]EvictionPolicy{"lru": EvictLRU, "Oldest": EvictOldest} {
+		if got, err := ParseEvictionPolicy(name); err != nil || got != want {
+			t.Errorf("%s: got %q, %v", name, got, err)
+		}
+	}
+	if _, err := ParseEvictionPolicy("random"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
+
+// fillQuotaCache stores entries a, b and c, about 1KB each, in that order
+func fillQuotaCache(t *testing.T, policy EvictionPolicy) *BadgerCache {
+	t.Helper()
+
+	c, err := NewBadgerCache(t.TempDir(), time.Hour, WithMaxSize(3500, policy))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	body := bytes.Repeat([]byte("x"), 1000)
+	for _, path := range []string{"a", "b", "c"} {
+		if err := c.Set("https://example.com/"+path, &CachedResponse{Data: body}); err != nil {
+			t.Fatalf("failed to set: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c
+}
+
+func assertCached(t *testing.T, c *BadgerCache, want map[string]bool) {
+	t.Helper()
+	for path, cached := range want {
+		if _, found, _ := c.Get("https://example.com/" + path); found != cached {
+			t.Errorf("%s: cached = %v, want %v", path, found, cached)
+		}
+	}
+}
+
+func TestQuota_EvictsOldestFirst(t *testing.T) {
+	c := fillQuotaCache(t, EvictOldest)
+
+	// Reading a does not save it under oldest-first
+	c.Get("https://example.com/a")
+	c.Set("https://example.com/d", &CachedResponse{Data: bytes.Repeat([]byte("x"), 1000)})
+	if _, err := c.enforceQuota(); err != nil {
+		t.Fatalf("eviction failed: %v", err)
+	}
+
+	assertCached(t, c, map[string]bool{"a": false, "b": true, "c": true, "d": true})
+	stats := c.QuotaStats()
+	if stats.Evictions != 1 || stats.UsedBytes == nil || *stats.UsedBytes > stats.MaxBytes || stats.Entries == nil || *stats.Entries != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestQuotaStats_OmitUsageWithoutQuota(t *testing.T) {
+	c, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+	c.Set("https://example.com/a", &CachedResponse{Data: []byte("a")})
+
+	if stats := c.QuotaStats(); stats.UsedBytes != nil || stats.Entries != nil {
+		t.Errorf("expected no usage without a quota, got %+v", stats)
+	}
+}
+
+func TestQuota_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := fillQuotaCache(t, EvictLRU)
+
+	c.Get("https://example.com/a")
+	c.Set("https://example.com/d", &CachedResponse{Data: bytes.Repeat([]byte("x"), 1000)})
+	if _, err := c.enforceQuota(); err != nil {
+		t.Fatalf("eviction failed: %v", err)
+	}
+
+	assertCached(t, c, map[string]bool{"a": true, "b": false, "c": true, "d": true})
+}
+
+func TestQuota_EvictsFromMemoryTier(t *testing.T) {
+	c := fillQuotaCache(t, EvictOldest)
+	tiered := NewTieredCache(c, 1<<20)
+	tiered.Get("https://example.com/a")
+
+	tiered.Set("https://example.com/d", &CachedResponse{Data: bytes.Repeat([]byte("x"), 1000)})
+	c.enforceQuota()
+
+	if _, found, _ := tiered.Get("https://example.com/a"); found {
+		t.Error("expected the evicted entry to leave memory too")
+	}
+}
+
+func TestQuota_EvictsInBackground(t *testing.T) {
+	c, err := NewBadgerCache(t.TempDir(), time.Hour, WithMaxSize(5000, EvictOldest))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	body := bytes.Repeat([]byte("x"), 1000)
+	for i := range 10 {
+		c.Set(fmt.Sprintf("https://example.com/%d", i), &CachedResponse{Data: body})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.QuotaStats().Evictions == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected writes over quota to trigger eviction")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuota_RefusesWritesWhenDiskIsFull(t *testing.T) {
+	c, err := NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	if !c.refuseWrite(fmt.Errorf("write failed: %w", syscall.ENOSPC)) {
+		t.Fatal("expected ENOSPC to be refused")
+	}
+	if err := c.Set("https://example.com/", &CachedResponse{Data: []byte("data")}); err != nil {
+		t.Errorf("expected a refused write without an error, got %v", err)
+	}
+	if _, found, _ := c.Get("https://example.com/"); found {
+		t.Error("expected the write to be skipped")
+	}
+	if stats := c.QuotaStats(); !stats.DiskFull || stats.RefusedWrites != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// Maintenance clears the condition
+	c.collectGarbage()
+	c.Set("https://example.com/", &CachedResponse{Data: []byte("data")})
+	if _, found, _ := c.Get("https://example.com/"); !found {
+		t.Error("expected writes to resume")
+	}
+
+	// So does deleting entries
+	c.refuseWrite(syscall.ENOSPC)
+	c.Delete("https://example.com/")
+	c.Set("https://example.com/", &CachedResponse{Data: []byte("data")})
+	if _, found, _ := c.Get("https://example.com/"); !found {
+		t.Error("expected writes to resume after a delete")
+	}
+
+	// Without maintenance or deletes, a write is retried after a while
+	c.refuseWrite(syscall.ENOSPC)
+	c.quota.fullSince.Add(-int64(diskFullRetry))
+	c.Set("https://example.com/other", &CachedResponse{Data: []byte("data")})
+	if stats := c.QuotaStats(); stats.DiskFull {
+		t.Error("expected a successful retried write to clear the condition")
+	}
+}
@@ -0,0 +1,197 @@
+package cache
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultMaxVariants is how many variants are kept per URL by default
+const DefaultMaxVariants = 8
+
+// WithMaxVariants caps how many variants of a URL are stored. Storing one
+// more drops the oldest.
+func WithMaxVariants(n int) Option {
+	return func(c *BadgerCache) {
+		c.maxVariants = max(n, 1)
+	}
+}
+
+// VaryFields returns the request header fields named by the Vary headers
+// of a response, lowercased and sorted. ok is false for "Vary: *", which
+// no later request matches.
+func VaryFields(header http.Header) (fields []string, ok bool) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.ToLower(strings.TrimSpace(field))
+			switch {
+			case field == "":
+				continue
+			case field == "*":
+				return nil, false
+			case !slices.Contains(fields, field):
+				fields = append(fields, field)
+			}
+		}
+	}
+	sort.Strings(fields)
+	return fields, true
+}
+
+// VariantURL returns the URL the variant selected by a request's headers
+// is stored under. It extends the fragment, so variants share the URL's
+// host and prefix and purges find them.
+func VariantURL(rawURL string, fields []string, header http.Header) string {
+	values := make(url.Values, len(fields))
+	for _, field := range fields {
+		values.Set("vary."+field, fieldValue(header.Values(field)))
+	}
+
+	separator := "#"
+	if strings.Contains(rawURL, "#") {
+		separator = "&"
+	}
+	return rawURL + separator + values.Encode()
+}
+
+// fieldValue joins the values of a header field, ignoring whitespace
+// around list elements
+func fieldValue(values []string) string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return strings.Join(items, ",")
+}
+
+// getVariant looks up a URL and, if its responses vary, the variant
+// matching the request header
+func getVariant(get func(string) (*CachedResponse, bool, error), rawURL string, header http.Header) (*CachedResponse, bool, error) {
+	entry, found, err := get(rawURL)
+	if err != nil || !found || len(entry.Variants) == 0 {
+		return entry, found, err
+	}
+	return get(VariantURL(rawURL, entry.Vary, header))
+}
+
+// GetVariant returns the entry for a URL, or the variant matching the
+// request header if the URL's responses vary
+func (c *BadgerCache) GetVariant(url string, header http.Header) (*CachedResponse, bool, error) {
+	return getVariant(c.Get, url, header)
+}
+
+// SetVariant stores a response that varies on the given request header
+// fields as the variant selected by header. Without fields it is stored
+// like Set, replacing any variants.
+func (c *BadgerCache) SetVariant(url string, vary []string, header http.Header, response *CachedResponse) error {
+	_, _, _, _, err := c.setVariant(url, vary, header, response)
+	return err
+}
+
+// setVariant stores a response and updates the entry listing the URL's
+// variants. It returns the stored entry, the URL it is stored under, when
+// Badger will drop it and the variant URLs that were removed.
+func (c *BadgerCache) setVariant(url string, vary []string, header http.Header, response *CachedResponse) (*CachedResponse, string, time.Time, []string, error) {
+	c.varyMu.Lock()
+	defer c.varyMu.Unlock()
+
+	previous, previousUntil, found, err := c.get(url)
+	if err != nil {
+		return nil, url, time.Time{}, nil, err
+	}
+	var variants, dropped []string
+	if found && len(previous.Variants) > 0 {
+		if slices.Equal(previous.Vary, vary) {
+			variants = previous.Variants
+		} else {
+			dropped = previous.Variants
+			previousUntil = time.Time{}
+		}
+	}
+
+	if len(vary) == 0 {
+		stored, retainUntil, err := c.set(url, response)
+		if err == nil && len(dropped) > 0 {
+			err = c.deleteURLs(dropped)
+		}
+		return stored, url, retainUntil, dropped, err
+	}
+
+	variantURL := VariantURL(url, vary, header)
+	variant := *response
+	variant.Vary = vary
+	stored, retainUntil, err := c.set(variantURL, &variant)
+	if err != nil || stored == nil {
+		return stored, variantURL, retainUntil, nil, err
+	}
+
+	// The newest variant goes last; the oldest beyond the cap are dropped
+	variants = append(slices.DeleteFunc(slices.Clone(variants), func(u string) bool { return u == variantURL }), variantURL)
+	if over := len(variants) - c.maxVariants; over > 0 {
+		dropped = append(dropped, variants[:over]...)
+		variants = variants[over:]
+	}
+	if len(dropped) > 0 {
+		if err := c.deleteURLs(dropped); err != nil {
+			return stored, variantURL, retainUntil, dropped, err
+		}
+	}
+
+	// The list lives as long as its longest-lived variant
+	now := time.Now()
+	listUntil := retainUntil
+	if previousUntil.After(listUntil) {
+		listUntil = previousUntil
+	}
+	list := &CachedResponse{
+		Vary:      vary,
+		Variants:  variants,
+		StoredAt:  now,
+		ExpiresAt: listUntil,
+	}
+	if _, _, err := c.write(url, list, listUntil.Sub(now)); err != nil {
+		return stored, variantURL, retainUntil, dropped, err
+	}
+	return stored, variantURL, retainUntil, dropped, nil
+}
+
+// GetVariant returns the entry for a URL, or the variant matching the
+// request header if the URL's responses vary. It counts once in the tier
+// stats, for the tier the returned entry came from.
+func (c *TieredCache) GetVariant(url string, header http.Header) (*CachedResponse, bool, error) {
+	tier := tierNone
+	entry, found, err := getVariant(func(url string) (*CachedResponse, bool, error) {
+		var entry *CachedResponse
+		var err error
+		entry, tier, err = c.lookup(url)
+		return entry, tier != tierNone, err
+	}, url, header)
+	c.count(tier)
+	return entry, found, err
+}
+
+// SetVariant stores a variant on disk and in memory
+func (c *TieredCache) SetVariant(url string, vary []string, header http.Header, response *CachedResponse) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	stored, storedURL, retainUntil, dropped, err := c.disk.setVariant(url, vary, header, response)
+	// The list of variants changed on disk and is read again from there
+	c.hot.remove(url)
+	for _, variantURL := range dropped {
+		c.hot.remove(variantURL)
+	}
+	if err != nil || stored == nil {
+		c.hot.remove(storedURL)
+		return err
+	}
+	c.hot.add(storedURL, stored, retainUntil)
+	return nil
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVaryFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		vary   []string
+		fields []string
+		ok     bool
+	}{
+		{"none", nil, nil, true},
+		{"sorted and lowercased", []string{"Accept-Language, Accept-Encoding"}, []string{"accept-encoding", "accept-language"}, true},
+		{"repeated headers", []string{"Accept", "accept, Origin"}, []string{"accept", "origin"}, true},
+		{"star", []string{"Accept, *"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, ok := VaryFields(http.Header{"Vary": tt.vary})
+			if ok != tt.ok || !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("got %v %v, want %v %v", fields, ok, tt.fields, tt.ok)
+			}
+		})
+	}
+}
+
+func TestVariantURL(t *testing.T) {
+	fields := []string{"accept-encoding", "accept-language"}
+
+	a := VariantURL("https://example.com/a", fields, http.Header{"Accept-Language": {"en, fr"}, "Accept-Encoding": {"gzip"}})
+	b := VariantURL("https://example.com/a", fields, http.Header{"Accept-Language": {"en,fr"}, "Accept-Encoding": {"gzip"}})
+	if a != b {
+		t.Errorf("whitespace should not matter: %q != %q", a, b)
+	}
+	if want := "https://example.com/a#vary.accept-encoding=gzip&vary.accept-language=en%2Cfr"; a != want {
+		t.Errorf("got %q, want %q", a, want)
+	}
+
+	// Keys that already carry a fragment are extended
+	got := VariantURL("https://example.com/a#accept=x", []string{"origin"}, http.Header{})
+	if want := "https://example.com/a#accept=x&vary.origin="; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCache_StoresVariants(t *testing.T) {
+	c, err := NewBadgerCache(t.TempDir(), time.Hour, WithMaxVariants(2))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+
+	const url = "https://example.com/page"
+	vary := []string{"accept-language"}
+	lang := func(l string) http.Header { return http.Header{"Accept-Language": {l}} }
+
+	for _, l := range []string{"en", "fr"} {
+		if err := c.SetVariant(url, vary, lang(l), &CachedResponse{Data: []byte(l)}); err != nil {
+			t.Fatalf("failed to set %s: %v", l, err)
+		}
+	}
+	for _, l := range []string{"en", "fr"} {
+		entry, found, err := c.GetVariant(url, lang(l))
+		if err != nil || !found || string(entry.Data) != l {
+			t.Errorf("%s: unexpected result %v %v %v", l, entry, found, err)
+		}
+	}
+	if _, found, _ := c.GetVariant(url, lang("de")); found {
+		t.Error("expected a miss for an unknown variant")
+	}
+
+	// A third variant drops the oldest
+	c.SetVariant(url, vary, lang("de"), &CachedResponse{Data: []byte("de")})
+	if _, found, _ := c.GetVariant(url, lang("en")); found {
+		t.Error("expected the oldest variant to be dropped")
+	}
+	if _, found, _ := c.Get(VariantURL(url, vary, lang("en"))); found {
+		t.Error("expected the dropped variant to be deleted")
+	}
+	list, _, _ := c.Get(url)
+	if len(list.Variants) != 2 {
+		t.Errorf("expected 2 variants, got %v", list.Variants)
+	}
+
+	// Responses that stop varying replace every variant
+	c.SetVariant(url, nil, lang("de"), &CachedResponse{Data: []byte("any")})
+	entry, found, _ := c.GetVariant(url, lang("fr"))
+	if !found || string(entry.Data) != "any" {
+		t.Errorf("expected the plain entry, got %v", entry)
+	}
+	if _, found, _ := c.Get(VariantURL(url, vary, lang("fr"))); found {
+		t.Error("expected the old variants to be deleted")
+	}
+}
+
+func TestTieredCache_StoresVariants(t *testing.T) {
+	c := newTestTieredCache(t, 1<<20)
+
+	const url = "https://example.com/page"
+	vary := []string{"accept-language"}
+	for _, l := range []string{"en", "fr"} {
+		c.SetVariant(url, vary, http.Header{"Accept-Language": {l}}, &CachedResponse{Data: []byte(l)})
+	}
+
+	for i := 0; i < 2; i++ {
+		entry, found, _ := c.GetVariant(url, http.Header{"Accept-Language": {"fr"}})
+		if !found || string(entry.Data) != "fr" {
+			t.Fatalf("unexpected entry %v", entry)
+		}
+	}
+	// Each lookup counts once, though it reads the list and the variant
+	if stats := c.TierStats(); stats.MemoryHits != 2 || stats.DiskHits != 0 || stats.Misses != 0 {
+		t.Errorf("expected 2 memory hits, got %+v", stats)
+	}
+
+	// Purging the URL removes its variants from both tiers
+	if n, _ := c.PurgePrefix(url); n != 3 {
+		t.Errorf("expected 3 purged entries, got %d", n)
+	}
+	if _, found, _ := c.GetVariant(url, http.Header{"Accept-Language": {"fr"}}); found {
+		t.Error("expected the variant to be purged")
+	}
+}
@@ -0,0 +1,159 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/harold/proxy-harold/internal/httperror"
+)
+
+// allowedMethods are the methods the proxy accepts cross-origin
+const allowedMethods = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// Policy decides which web origins may use the proxy. Origins are matched
+// exactly ("https://app.example.com"), by subdomain wildcard
+// ("https://*.example.com") or by regular expression ("^https://pr-\d+\.example\.com$").
+// A single "*" allows every origin.
+type Policy struct {
+	allowAll    bool
+	exact       map[string]bool
+	wildcards   []wildcard
+	patterns    []*regexp.Regexp
+	credentials bool
+}
+
+// wildcard matches any subdomain of suffix under one scheme
+type wildcard struct {
+	scheme string
+	suffix string
+}
+
+// NewPolicy creates a policy from origin patterns. With allowCredentials
+// the matched origin is reflected instead of "*", as browsers require.
+func NewPolicy(origins []string, allowCredentials bool) (*Policy, error) {
+	p := &Policy{
+		exact:       make(map[string]bool),
+		credentials: allowCredentials,
+	}
+
+	for _, origin := range origins {
+		switch {
+		case origin == "*":
+			p.allowAll = true
+		case strings.HasPrefix(origin, "^"):
+			re, err := regexp.Compile(origin)
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin pattern %q: %w", origin, err)
+			}
+			p.patterns = append(p.patterns, re)
+		case strings.Contains(origin, "://*."):
+			scheme, host, _ := strings.Cut(strings.ToLower(origin), "://*.")
+			p.wildcards = append(p.wildcards, wildcard{scheme: scheme, suffix: "." + host})
+		default:
+			p.exact[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+
+	return p, nil
+}
+
+// Allows reports whether an origin such as "https://app.example.com" may
+// use the proxy
+func (p *Policy) Allows(origin string) bool {
+	if p.allowAll {
+		return true
+	}
+
+	origin = strings.ToLower(origin)
+	if p.exact[origin] {
+		return true
+	}
+	if scheme, host, ok := strings.Cut(origin, "://"); ok {
+		for _, w := range p.wildcards {
+			if w.scheme == scheme && strings.HasSuffix(host, w.suffix) {
+				return true
+			}
+		}
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware sets CORS headers and answers preflight requests. Requests
+// whose Origin, or Referer when there is no Origin, is not allowed are
+// rejected with 403 before reaching next. Requests carrying neither come
+// from outside a browser and are let through.
+func (p *Policy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		// Anything but a plain "*" depends on the request's origin
+		reflect := !p.allowAll || p.credentials
+		if reflect {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if source := RequestOrigin(r); source != "" && !p.Allows(source) {
+			httperror.Write(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case reflect && origin != "" && origin != "null":
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if p.credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		case !reflect:
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+
+		if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+			p.preflight(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// preflight answers a CORS preflight request
+func (p *Policy) preflight(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+	if p.credentials {
+		// "*" is taken literally for credentialed requests
+		if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+			w.Header().Set("Access-Control-Allow-Headers", requested)
+		}
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+	} else {
+		w.Header().Set("Access-Control-Allow-Headers", "*")
+	}
+	w.Header().Set("Access-Control-Max-Age", "86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestOrigin returns the Origin header, or the origin of the Referer
+// when there is none
+func RequestOrigin(r *http.Request) string {
+	if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+		return origin
+	}
+
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		return ""
+	}
+	parsed, err := url.Parse(referer)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
@@ -0,0 +1,174 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(t *testing.T, p *Policy, method string, header http.Header) (*httptest.ResponseRecorder, bool) {
+	t.Helper()
+
+	reached := false
+	h := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.Write([]byte("ok"))
+	}))
+
+	req := httptest.NewRequest(method, "/?url=https://example.com", nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec, reached
+}
+
+func TestPolicy_Allows(t *testing.T) {
+	p, err := NewPolicy([]string{
+		"https://app.example.com",
+		"https://*.partner.org",
+		`^https://pr-\d+\.preview\.example\.com$`,
+	}, false)
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	tests := map[string]bool{
+		"https://app.example.com":             true,
+		"https://APP.example.com":             true,
+		"http://app.example.com":              false,
+		"https://app.example.com:8443":        false,
+		"https://cdn.partner.org":             true,
+		"https://a.b.partner.org":             true,
+		"https://partner.org":                 false,
+		"https://evilpartner.org":             false,
+		"https://pr-42.preview.example.com":   true,
+		"https://pr-x.preview.example.com":    false,
+		"https://pr-42.preview.example.com.x": false,
+	}
+	for origin, want := range tests {
+		if got := p.Allows(origin); got != want {
+			t.Errorf("Allows(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestPolicy_RejectsInvalidRegex(t *testing.T) {
+	if _, err := NewPolicy([]string{"^https://(unclosed"}, false); err == nil {
+		t.Error("expected an error for an invalid pattern")
+	}
+}
+
+func TestMiddleware_AllowAllUsesWildcard(t *testing.T) {
+	p, _ := NewPolicy([]string{"*"}, false)
+	rec, reached := serve(t, p, "GET", http.Header{"Origin": {"https://somesite.com"}})
+
+	if !reached {
+		t.Fatal("expected the request to be passed on")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("expected CORS header *, got %q", got)
+	}
+	if rec.Header().Get("Vary") != "" {
+		t.Errorf("expected no Vary for a wildcard policy, got %q", rec.Header().Get("Vary"))
+	}
+}
+
+func TestMiddleware_HandlesPreflight(t *testing.T) {
+	p, _ := NewPolicy([]string{"*"}, false)
+	rec, reached := serve(t, p, "OPTIONS", http.Header{
+		"Origin":                        {"https://somesite.com"},
+		"Access-Control-Request-Method": {"POST"},
+	})
+
+	if reached {
+		t.Error("expected the preflight to be answered by the middleware")
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204 for preflight, got %d", rec.Code)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected CORS header *, got %q", rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+	if rec.Header().Get("Access-Control-Allow-Methods") == "" {
+		t.Error("expected Access-Control-Allow-Methods header")
+	}
+}
+
+func TestMiddleware_ReflectsAllowedOrigins(t *testing.T) {
+	p, _ := NewPolicy([]string{"https://app.example.com"}, false)
+
+	rec, reached := serve(t, p, "GET", http.Header{"Origin": {"https://app.example.com"}})
+	if !reached {
+		t.Fatal("expected the request to be passed on")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("expected the origin to be reflected, got %q", got)
+	}
+	if got := rec.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("expected Vary: Origin, got %q", got)
+	}
+	if rec.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("expected no credentials header unless enabled")
+	}
+}
+
+func TestMiddleware_RejectsDisallowedOrigins(t *testing.T) {
+	p, _ := NewPolicy([]string{"https://app.example.com"}, false)
+
+	for _, header := range []http.Header{
+		{"Origin": {"https://evil.example"}},
+		{"Referer": {"https://evil.example/page"}},
+	} {
+		rec, reached := serve(t, p, "GET", header)
+		if reached {
+			t.Errorf("%v: expected the request to stop before the proxy", header)
+		}
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%v: expected 403, got %d", header, rec.Code)
+		}
+		if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%v: expected no CORS grant", header)
+		}
+	}
+
+	// A disallowed preflight is rejected too
+	rec, _ := serve(t, p, "OPTIONS", http.Header{
+		"Origin":                        {"https://evil.example"},
+		"Access-Control-Request-Method": {"GET"},
+	})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for disallowed preflight, got %d", rec.Code)
+	}
+
+	// Referer from an allowed page, and requests from outside a browser, pass
+	for _, header := range []http.Header{
+		{"Referer": {"https://app.example.com/page"}},
+		{},
+	} {
+		if _, reached := serve(t, p, "GET", header); !reached {
+			t.Errorf("%v: expected the request to be passed on", header)
+		}
+	}
+}
+
+func TestMiddleware_AllowsCredentials(t *testing.T) {
+	p, _ := NewPolicy([]string{"*"}, true)
+
+	rec, _ := serve(t, p, "OPTIONS", http.Header{
+		"Origin":                         {"https://app.example.com"},
+		"Access-Control-Request-Method":  {"GET"},
+		"Access-Control-Request-Headers": {"Authorization, X-Api-Key"},
+	})
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("expected the origin to be reflected with credentials, got %q", got)
+	}
+	if rec.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("expected Access-Control-Allow-Credentials: true")
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Headers"); got != "Authorization, X-Api-Key" {
+		t.Errorf("expected requested headers to be reflected, got %q", got)
+	}
+}
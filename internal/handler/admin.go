@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/cache"
+	"github.com/harold/proxy-harold/internal/proxy"
+)
+
+// AdminCache is the cache interface needed by the admin API
+type AdminCache interface {
+	Cache
+	PurgePrefix(prefix string) (int, error)
+	PurgeHost(host string) (int, error)
+	PurgeAll() error
+}
+
+// AdminHandler serves /admin/cache for inspecting and purging entries.
+// Every request must carry "Authorization: Bearer <token>".
+type AdminHandler struct {
+	cache   AdminCache
+	token   string
+	keys    *cache.KeyNormalizer
+	fetcher *proxy.Fetcher
+}
+
+// AdminOption configures an AdminHandler
+type AdminOption func(*AdminHandler)
+
+// WithAdminKeyNormalizer normalizes the 'url' parameter the same way the
+// proxy normalizes cache keys
+func WithAdminKeyNormalizer(n *cache.KeyNormalizer) AdminOption {
+	return func(h *AdminHandler) {
+		h.keys = n
+	}
+}
+
+// WithAdminFetcher looks up the host rules of the proxy's fetcher, so the
+// 'url' parameter finds entries fetched with injected credentials or keyed
+// on request headers
+func WithAdminFetcher(f *proxy.Fetcher) AdminOption {
+	return func(h *AdminHandler) {
+		h.fetcher = f
+	}
+}
+
+// NewAdminHandler creates an admin handler. An empty token rejects every
+// request.
+func NewAdminHandler(c AdminCache, token string, opts ...AdminOption) *AdminHandler {
+	h := &AdminHandler{
+		cache: c,
+		token: token,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// EntryMetadata describes a cached entry without its body. Variant holds
+// the key header values the entry is stored under, for hosts whose rule
+// sets key_headers.
+type EntryMetadata struct {
+	URL          string    `json:"url"`
+	Variant      string    `json:"variant,omitempty"`
+	Status       int       `json:"status"`
+	Size         int       `json:"size"`
+	StoredSize   int       `json:"stored_size"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	StoredAt     time.Time `json:"stored_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Fresh        bool      `json:"fresh"`
+	Vary         []string  `json:"vary,omitempty"`
+	Variants     []string  `json:"variants,omitempty"`
+}
+
+// PurgeResponse reports how many entries a purge removed
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+// ServeHTTP handles:
+//
+//	GET    /admin/cache?url=<URL>     entry metadata
+//	DELETE /admin/cache?url=<URL>     purge one entry
+//	DELETE /admin/cache?prefix=<URL>  purge entries whose URL starts with prefix
+//	DELETE /admin/cache?host=<host>   purge entries for a hostname
+//	DELETE /admin/cache?all=true      purge everything
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, h.token) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.lookup(w, r)
+	case http.MethodDelete:
+		h.purge(w, r)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requireAdmin checks the bearer token in constant time and answers 401
+// when it does not match. An empty token never matches.
+func requireAdmin(w http.ResponseWriter, r *http.Request, token string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != "" && ok && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+		return true
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+	writeError(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// lookup returns the metadata of a single entry
+func (h *AdminHandler) lookup(w http.ResponseWriter, r *http.Request) {
+	targetURL := r.URL.Query().Get("url")
+	if targetURL == "" {
+		writeError(w, ErrMissingTarget.Error(), http.StatusBadRequest)
+		return
+	}
+	// Hosts keyed on request headers are looked up with the values the
+	// admin request carries
+	base, variant := h.key(targetURL), ""
+	if names := h.keyHeaders(targetURL); len(names) > 0 {
+		variant = keyHeaders(names, r.Header)
+	}
+	key := base + variant
+
+	entry, found, err := h.cache.Get(key)
+	if err != nil {
+		writeError(w, "cache lookup failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		writeError(w, "not cached", http.StatusNotFound)
+		return
+	}
+
+	// The key's namespace and fragment are internal to the cache
+	sendJSON(w, metadataOf(strings.TrimPrefix(base, injectedNamespace), strings.TrimPrefix(variant, "#"), entry), http.StatusOK)
+}
+
+// purge removes the entries selected by exactly one query parameter
+func (h *AdminHandler) purge(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	selectors := 0
+	for _, name := range []string{"url", "prefix", "host", "all"} {
+		if query.Has(name) {
+			selectors++
+		}
+	}
+	if selectors != 1 {
+		writeError(w, "specify exactly one of 'url', 'prefix', 'host' or 'all'", http.StatusBadRequest)
+		return
+	}
+
+	if query.Has("all") {
+		if query.Get("all") != "true" {
+			writeError(w, "'all' must be 'true'", http.StatusBadRequest)
+			return
+		}
+		if err := h.cache.PurgeAll(); err != nil {
+			writeError(w, "purge failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Dropping everything does not count the entries
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var purged int
+	var err error
+	switch {
+	case query.Has("url"):
+		targetURL := query.Get("url")
+		key := h.key(targetURL)
+		var entry *cache.CachedResponse
+		var found bool
+		if entry, found, err = h.cache.Get(key); err == nil && found {
+			err = h.cache.Delete(key)
+			purged = 1
+			for _, variantURL := range entry.Variants {
+				if err == nil {
+					err = h.cache.Delete(variantURL)
+				}
+			}
+		}
+		// Every combination of key header values goes with the URL
+		if err == nil && len(h.keyHeaders(targetURL)) > 0 {
+			var combinations int
+			combinations, err = h.cache.PurgePrefix(key + "#")
+			purged += combinations
+		}
+	case query.Has("prefix"):
+		if query.Get("prefix") == "" {
+			writeError(w, "'prefix' must not be empty, use 'all' instead", http.StatusBadRequest)
+			return
+		}
+		prefix, injectedOnly := strings.CutPrefix(query.Get("prefix"), injectedNamespace)
+		if h.keys != nil {
+			prefix = h.keys.NormalizePrefix(prefix)
+		}
+		// Responses fetched with injected credentials live in their own
+		// namespace
+		purged, err = h.cache.PurgePrefix(injectedNamespace + prefix)
+		if err == nil && !injectedOnly {
+			var plain int
+			plain, err = h.cache.PurgePrefix(prefix)
+			purged += plain
+		}
+	case query.Has("host"):
+		purged, err = h.cache.PurgeHost(query.Get("host"))
+	}
+	if err != nil {
+		writeError(w, "purge failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sendJSON(w, PurgeResponse{Purged: purged}, http.StatusOK)
+}
+
+// key returns the cache key of a target URL, as the proxy builds it
+func (h *AdminHandler) key(targetURL string) string {
+	return targetKey(h.keys, h.fetcher, targetURL)
+}
+
+// keyHeaders returns the request headers the host rule of a target URL
+// adds to its cache keys
+func (h *AdminHandler) keyHeaders(targetURL string) []string {
+	if h.fetcher == nil {
+		return nil
+	}
+	if rule := h.fetcher.Rule(targetURL); rule != nil {
+		return rule.KeyHeaders
+	}
+	return nil
+}
+
+// metadataOf describes an entry
+func metadataOf(targetURL, variant string, entry *cache.CachedResponse) EntryMetadata {
+	variants := make([]string, len(entry.Variants))
+	for i, variantURL := range entry.Variants {
+		variants[i] = strings.TrimPrefix(variantURL, injectedNamespace)
+	}
+	return EntryMetadata{
+		URL:          targetURL,
+		Variant:      variant,
+		Status:       entry.Status(),
+		Size:         len(entry.Data),
+		StoredSize:   entry.StoredSize,
+		ContentType:  entry.ContentType,
+		ETag:         entry.ETag,
+		LastModified: entry.LastModified,
+		StoredAt:     entry.StoredAt,
+		ExpiresAt:    entry.ExpiresAt,
+		Fresh:        entry.IsFresh(time.Now()),
+		Vary:         entry.Vary,
+		Variants:     variants,
+	}
+}
+
+// Ensure both cache implementations satisfy the AdminCache interface
+var (
+	_ AdminCache = (*cache.BadgerCache)(nil)
+	_ AdminCache = (*cache.TieredCache)(nil)
+)
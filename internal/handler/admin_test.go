@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/cache"
+	"github.com/harold/proxy-harold/internal/proxy"
+)
+
+func newTestAdmin(t *testing.T) (*AdminHandler, *cache.BadgerCache) {
+	t.Helper()
+
+	c, err := cache.NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return NewAdminHandler(c, "secret"), c
+}
+
+func adminRequest(h http.Handler, method string, query url.Values, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/admin/cache?"+query.Encode(), nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdmin_RequiresToken(t *testing.T) {
+	h, _ := newTestAdmin(t)
+	query := url.Values{"url": {"https://example.com/"}}
+
+	for _, token := range []string{"", "wrong"} {
+		rec := adminRequest(h, "GET", query, token)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, rec.Code)
+		}
+	}
+
+	// An unconfigured token never matches
+	rec := adminRequest(NewAdminHandler(nil, ""), "GET", query, "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a configured token, got %d", rec.Code)
+	}
+}
+
+func TestAdmin_LooksUpMetadata(t *testing.T) {
+	h, c := newTestAdmin(t)
+	c.Set("https://example.com/data", &cache.CachedResponse{
+		StatusCode:  http.StatusOK,
+		Data:        []byte("hello"),
+		ContentType: "text/plain",
+		ETag:        `"v1"`,
+	})
+
+	rec := adminRequest(h, "GET", url.Values{"url": {"https://example.com/data"}}, "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	var meta EntryMetadata
+	if err := json.NewDecoder(rec.Body).Decode(&meta); err != nil {
+		t.Fatalf("failed to decode metadata: %v", err)
+	}
+	if meta.Size != 5 || meta.ContentType != "text/plain" || meta.ETag != `"v1"` || !meta.Fresh {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	if meta.StoredSize <= meta.Size {
+		t.Errorf("expected the stored size to include metadata, got %d", meta.StoredSize)
+	}
+	if meta.StoredAt.IsZero() || !meta.ExpiresAt.After(meta.StoredAt) {
+		t.Errorf("unexpected timestamps: stored %v, expires %v", meta.StoredAt, meta.ExpiresAt)
+	}
+
+	rec = adminRequest(h, "GET", url.Values{"url": {"https://example.com/missing"}}, "secret")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for uncached URL, got %d", rec.Code)
+	}
+}
+
+func TestAdmin_Purges(t *testing.T) {
+	h, c := newTestAdmin(t)
+	for _, u := range []string{
+		"https://example.com/a",
+		"https://example.com/b/1",
+		"https://example.com/b/2",
+		"https://example.org/c",
+		"https://example.net/d",
+	} {
+		c.Set(u, &cache.CachedResponse{Data: []byte(u)})
+	}
+
+	tests := []struct {
+		query url.Values
+		want  int
+	}{
+		{url.Values{"url": {"https://example.com/a"}}, 1},
+		{url.Values{"url": {"https://example.com/a"}}, 0},
+		{url.Values{"prefix": {"https://example.com/b/"}}, 2},
+		{url.Values{"host": {"example.org"}}, 1},
+	}
+	for _, tt := range tests {
+		rec := adminRequest(h, "DELETE", tt.query, "secret")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%v: expected 200, got %d", tt.query, rec.Code)
+		}
+		var resp PurgeResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Purged != tt.want {
+			t.Errorf("%v: expected %d purged, got %d", tt.query, tt.want, resp.Purged)
+		}
+	}
+
+	rec := adminRequest(h, "DELETE", url.Values{"all": {"true"}}, "secret")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for purge all, got %d", rec.Code)
+	}
+	if _, found, _ := c.Get("https://example.net/d"); found {
+		t.Error("expected every entry to be purged")
+	}
+}
+
+func TestAdmin_RejectsAmbiguousPurge(t *testing.T) {
+	h, _ := newTestAdmin(t)
+
+	for _, query := range []url.Values{
+		{},
+		{"url": {"https://example.com/"}, "host": {"example.com"}},
+		{"prefix": {""}},
+		{"all": {"yes"}},
+	} {
+		rec := adminRequest(h, "DELETE", query, "secret")
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestAdmin_NormalizesURL(t *testing.T) {
+	_, c := newTestAdmin(t)
+	h := NewAdminHandler(c, "secret", WithAdminKeyNormalizer(cache.NewKeyNormalizer(cache.DefaultStripParams)))
+	c.Set("https://example.com/data?a=1&b=2", &cache.CachedResponse{StatusCode: http.StatusOK, Data: []byte("x")})
+
+	query := url.Values{"url": {"HTTPS://example.com:443/data?b=2&a=1&utm_source=x"}}
+	if rec := adminRequest(h, "GET", query, "secret"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	rec := adminRequest(h, "DELETE", query, "secret")
+	var purge PurgeResponse
+	json.NewDecoder(rec.Body).Decode(&purge)
+	if rec.Code != http.StatusOK || purge.Purged != 1 {
+		t.Errorf("expected 1 purged entry, got %d (%d)", purge.Purged, rec.Code)
+	}
+
+	// Prefixes are normalized as far as they go
+	c.Set("https://example.com/data/b", &cache.CachedResponse{StatusCode: http.StatusOK, Data: []byte("x")})
+	rec = adminRequest(h, "DELETE", url.Values{"prefix": {"HTTPS://Example.com:443/data"}}, "secret")
+	purge = PurgeResponse{}
+	json.NewDecoder(rec.Body).Decode(&purge)
+	if rec.Code != http.StatusOK || purge.Purged != 1 {
+		t.Errorf("expected 1 entry purged by prefix, got %d (%d)", purge.Purged, rec.Code)
+	}
+}
+
+func TestAdmin_FindsInjectedEntries(t *testing.T) {
+	_, c := newTestAdmin(t)
+	rules, _ := proxy.NewHostRules([]proxy.HostRule{{
+		Host:   "api.example.com",
+		Action: proxy.ActionAllow,
+		Inject: &proxy.Injection{Headers: map[string]string{"X-Api-Key": "s3cret"}},
+	}}, true)
+	h := NewAdminHandler(c, "secret", WithAdminFetcher(proxy.NewFetcher(time.Second, 1024, proxy.WithHostRules(rules))))
+
+	for _, u := range []string{"/a", "/b", "/c"} {
+		c.Set("injected+https://api.example.com"+u, &cache.CachedResponse{StatusCode: http.StatusOK, Data: []byte(u)})
+	}
+
+	query := url.Values{"url": {"https://api.example.com/a"}}
+	rec := adminRequest(h, "GET", query, "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the injected entry, got %d", rec.Code)
+	}
+	var meta EntryMetadata
+	json.NewDecoder(rec.Body).Decode(&meta)
+	if meta.URL != "https://api.example.com/a" {
+		t.Errorf("expected the target URL without the namespace, got %q", meta.URL)
+	}
+
+	tests := []struct {
+		query url.Values
+		want  int
+	}{
+		{query, 1},
+		{url.Values{"prefix": {"https://api.example.com/"}}, 2},
+	}
+	for _, tt := range tests {
+		rec := adminRequest(h, "DELETE", tt.query, "secret")
+		var resp PurgeResponse
+		json.NewDecoder(rec.Body).Decode(&resp)
+		if resp.Purged != tt.want {
+			t.Errorf("%v: expected %d purged, got %d", tt.query, tt.want, resp.Purged)
+		}
+	}
+}
+
+func TestAdmin_FindsKeyHeaderEntries(t *testing.T) {
+	_, c := newTestAdmin(t)
+	rules, _ := proxy.NewHostRules([]proxy.HostRule{{
+		Host:       "example.com",
+		Action:     proxy.ActionAllow,
+		KeyHeaders: []string{"Accept-Language"},
+	}}, true)
+	h := NewAdminHandler(c, "secret", WithAdminFetcher(proxy.NewFetcher(time.Second, 1024, proxy.WithHostRules(rules))))
+
+	for _, lang := range []string{"en", "fr"} {
+		c.Set("https://example.com/page#accept-language="+lang, &cache.CachedResponse{StatusCode: http.StatusOK, Data: []byte(lang)})
+	}
+
+	req := httptest.NewRequest("GET", "/admin/cache?url=https://example.com/page", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Accept-Language", "fr")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var meta EntryMetadata
+	json.NewDecoder(rec.Body).Decode(&meta)
+	if rec.Code != http.StatusOK || meta.Size != 2 {
+		t.Fatalf("expected the fr entry, got %d %+v", rec.Code, meta)
+	}
+	if meta.URL != "https://example.com/page" || meta.Variant != "accept-language=fr" {
+		t.Errorf("expected the target URL and its variant, got %q and %q", meta.URL, meta.Variant)
+	}
+
+	rec = adminRequest(h, "DELETE", url.Values{"url": {"https://example.com/page"}}, "secret")
+	var purge PurgeResponse
+	json.NewDecoder(rec.Body).Decode(&purge)
+	if purge.Purged != 2 {
+		t.Errorf("expected both combinations purged, got %d", purge.Purged)
+	}
+}
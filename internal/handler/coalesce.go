@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/harold/proxy-harold/internal/cache"
+)
+
+// flight is an upstream fetch that concurrent requests for the same key wait on
+type flight struct {
+	done chan struct{}
+	// entry holds the complete response when it was small enough to buffer
+	entry *cache.CachedResponse
+	err   error
+	// header holds the leader's forwarded request headers, which select
+	// the variant of a response that varies
+	header http.Header
+}
+
+// matches reports whether the leader's response is the variant a request
+// with header would be served
+func (f *flight) matches(key string, header http.Header) bool {
+	if len(f.entry.Vary) == 0 {
+		return true
+	}
+	return cache.VariantURL(key, f.entry.Vary, f.header) == cache.VariantURL(key, f.entry.Vary, header)
+}
+
+// coalescer tracks in-flight upstream fetches by cache key
+type coalescer struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{flights: make(map[string]*flight)}
+}
+
+// join returns the in-flight fetch for key. If there is none, the caller
+// becomes the leader and must call finish once its fetch completes.
+func (c *coalescer) join(key string) (*flight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.flights[key]; ok {
+		return f, false
+	}
+
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	return f, true
+}
+
+// finish publishes the leader's result and wakes up the waiting requests
+func (c *coalescer) finish(key string, f *flight, entry *cache.CachedResponse, err error) {
+	c.mu.Lock()
+	delete(c.flights, key)
+	c.mu.Unlock()
+
+	f.entry = entry
+	f.err = err
+	close(f.done)
+}
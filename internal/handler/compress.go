@@ -0,0 +1,431 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/harold/proxy-harold/internal/cache"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings responses are compressed with, in order of preference
+const (
+	encodingBrotli = "br"
+	encodingZstd   = "zstd"
+	encodingGzip   = "gzip"
+)
+
+var supportedEncodings = []string{encodingBrotli, encodingZstd, encodingGzip}
+
+// DefaultCompressionMinSize is the smallest body compressed by default
+const DefaultCompressionMinSize = 1024
+
+// compressor compresses responses for clients that accept it
+type compressor struct {
+	// level is passed to each encoder on its own scale: gzip 1-9,
+	// brotli 0-11, zstd 1-22. Zero uses each encoder's default.
+	level   int
+	minSize int64
+
+	zstdEncoders sync.Pool
+}
+
+// WithCompression compresses text-like responses of at least minSize bytes
+// with gzip, brotli or zstd, as negotiated with the client's
+// Accept-Encoding. level applies to each encoder on its own scale, zero
+// picks their defaults.
+func WithCompression(level int, minSize int64) Option {
+	return func(h *ProxyHandler) {
+		h.compression = &compressor{level: level, minSize: minSize}
+	}
+}
+
+// DefaultMaxDecodedSize is the default limit for upstream-encoded bodies
+// decoded for clients
+const DefaultMaxDecodedSize = 100 * 1024 * 1024
+
+// ErrDecodedTooBig is returned when an upstream-encoded body decodes to
+// more than the allowed size
+var ErrDecodedTooBig = errors.New("decoded response exceeds maximum allowed size")
+
+// WithMaxDecodedSize limits how large upstream-encoded bodies may grow
+// when they are decoded for clients that do not accept their encoding
+func WithMaxDecodedSize(n int64) Option {
+	return func(h *ProxyHandler) {
+		h.maxDecodedSize = n
+	}
+}
+
+// negotiateEncoding picks the preferred coding with the highest quality
+// in an Accept-Encoding header, or "" for an uncompressed response
+func negotiateEncoding(accept string) string {
+	quality, wildcard := parseAcceptEncoding(accept)
+
+	best, bestQ := "", 0.0
+	for _, encoding := range supportedEncodings {
+		q, ok := quality[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows a coding
+func acceptsEncoding(accept, encoding string) bool {
+	quality, wildcard := parseAcceptEncoding(accept)
+	encoding = strings.ToLower(encoding)
+	if encoding == "x-gzip" {
+		encoding = encodingGzip
+	}
+	q, ok := quality[encoding]
+	if !ok {
+		q = wildcard
+	}
+	return q > 0
+}
+
+// parseAcceptEncoding returns the quality of each listed coding and of
+// "*", which is -1 if absent
+func parseAcceptEncoding(accept string) (map[string]float64, float64) {
+	quality := make(map[string]float64)
+	wildcard := -1.0
+	for _, item := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				parsed, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		switch name {
+		case "":
+		case "*":
+			wildcard = q
+		case "x-gzip":
+			quality[encodingGzip] = q
+		default:
+			quality[name] = q
+		}
+	}
+	return quality, wildcard
+}
+
+// applies reports whether a response is worth compressing. size is -1 when
+// it is not known in advance.
+func (c *compressor) applies(contentType string, size int64, header http.Header) bool {
+	if c == nil || header.Get("Content-Encoding") != "" || !cache.Compressible(contentType) {
+		return false
+	}
+	return size < 0 || size >= c.minSize
+}
+
+// encoding returns the coding to compress a response with for a request,
+// or "" to send it as it is. Range requests are answered uncompressed.
+func (c *compressor) encoding(r *http.Request, contentType string, size int64, header http.Header) string {
+	if !c.applies(contentType, size, header) || r.Header.Get("Range") != "" {
+		return ""
+	}
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"))
+}
+
+// writer returns an encoder writing to w. Closing it flushes the encoder
+// without closing w.
+func (c *compressor) writer(encoding string, w io.Writer) io.WriteCloser {
+	switch encoding {
+	case encodingBrotli:
+		level := brotli.DefaultCompression
+		if c.level != 0 {
+			level = min(max(c.level, brotli.BestSpeed), brotli.BestCompression)
+		}
+		return brotli.NewWriterLevel(w, level)
+	case encodingZstd:
+		enc, _ := c.zstdEncoders.Get().(*zstd.Encoder)
+		if enc == nil {
+			level := zstd.SpeedDefault
+			if c.level != 0 {
+				level = zstd.EncoderLevelFromZstd(c.level)
+			}
+			enc, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		}
+		enc.Reset(w)
+		return &pooledZstd{Encoder: enc, pool: &c.zstdEncoders}
+	default:
+		level := gzip.DefaultCompression
+		if c.level != 0 {
+			level = min(max(c.level, gzip.BestSpeed), gzip.BestCompression)
+		}
+		gz, _ := gzip.NewWriterLevel(w, level)
+		return gz
+	}
+}
+
+// pooledZstd returns its encoder to the pool once closed
+type pooledZstd struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (z *pooledZstd) Close() error {
+	err := z.Encoder.Close()
+	z.pool.Put(z.Encoder)
+	return err
+}
+
+// compress encodes a complete body
+func (c *compressor) compress(encoding string, data []byte) []byte {
+	var buf bytes.Buffer
+	enc := c.writer(encoding, &buf)
+	enc.Write(data)
+	enc.Close()
+	return buf.Bytes()
+}
+
+// encodedKey returns the key the compressed copy of a cached entry is
+// stored under. It names the entry's variant and when it was stored, so a
+// refreshed entry never serves an outdated copy.
+func encodedKey(key string, entry *cache.CachedResponse, header http.Header, encoding string) string {
+	if len(entry.Vary) > 0 {
+		key = cache.VariantURL(key, entry.Vary, header)
+	}
+	separator := "#"
+	if strings.Contains(key, "#") {
+		separator = "&"
+	}
+	return key + separator + "encoding=" + encoding + "&stored=" + strconv.FormatInt(entry.StoredAt.UnixNano(), 10)
+}
+
+// peeker is implemented by caches that count lookups but can also look up
+// entries without counting them
+type peeker interface {
+	Peek(url string) (*cache.CachedResponse, bool, error)
+}
+
+// derivedCopy looks up a compressed or decoded copy of an entry. The entry
+// itself was already counted in the cache stats, so the copy is not.
+func (h *ProxyHandler) derivedCopy(key string) (*cache.CachedResponse, bool, error) {
+	if p, ok := h.cache.(peeker); ok {
+		return p.Peek(key)
+	}
+	return h.cache.Get(key)
+}
+
+// encodedCopy returns the compressed copy of a cached entry, compressing
+// and caching it on first use. Responses shared with coalesced requests
+// are not stored yet and are compressed every time.
+func (h *ProxyHandler) encodedCopy(key string, r *http.Request, entry *cache.CachedResponse, encoding string) *cache.CachedResponse {
+	encKey := ""
+	if !entry.StoredAt.IsZero() {
+		encKey = encodedKey(key, entry, h.reqHeaders.Filter(r.Header), encoding)
+		if encoded, found, err := h.derivedCopy(encKey); err == nil && found {
+			return encoded
+		}
+	}
+
+	encoded := *entry
+	encoded.Data = h.compression.compress(encoding, entry.Data)
+	encoded.Header = entry.Header.Clone()
+	if encoded.Header == nil {
+		encoded.Header = make(http.Header)
+	}
+	encoded.Header.Set("Content-Encoding", encoding)
+	encoded.Vary, encoded.Variants = nil, nil
+	if encKey != "" {
+		_ = h.cache.Set(encKey, &encoded)
+	}
+	return &encoded
+}
+
+// markEncoded sets the headers of a response compressed by the proxy
+func markEncoded(header http.Header, encoding string) {
+	header.Set("Content-Encoding", encoding)
+	header.Del("Content-Length")
+	weakenETag(header)
+}
+
+// weakenETag marks the ETag weak, as the bytes sent differ from upstream's
+func weakenETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// decodable reports whether the proxy can decode a content coding
+func decodable(encoding string) bool {
+	switch strings.ToLower(encoding) {
+	case encodingGzip, "x-gzip", encodingBrotli, encodingZstd:
+		return true
+	}
+	return false
+}
+
+// decoder returns a reader decoding body, or false for codings the proxy
+// cannot decode. Reading more than the decoded size limit fails with
+// ErrDecodedTooBig.
+func (h *ProxyHandler) decoder(encoding string, body io.Reader) (io.ReadCloser, bool) {
+	var decoded io.ReadCloser
+	switch strings.ToLower(encoding) {
+	case encodingGzip, "x-gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return io.NopCloser(errorReader{fmt.Errorf("invalid gzip body: %w", err)}), true
+		}
+		decoded = gz
+	case encodingBrotli:
+		decoded = io.NopCloser(brotli.NewReader(body))
+	case encodingZstd:
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return io.NopCloser(errorReader{err}), true
+		}
+		decoded = zr.IOReadCloser()
+	default:
+		return nil, false
+	}
+	return &decodedBody{ReadCloser: decoded, remaining: h.maxDecodedSize}, true
+}
+
+// needsDecoding reports whether an upstream-encoded response must be
+// decoded for a request. Ranges always apply to the decoded body.
+func needsDecoding(r *http.Request, encoding string) bool {
+	if encoding == "" || !decodable(encoding) {
+		return false
+	}
+	return r.Header.Get("Range") != "" || !acceptsEncoding(r.Header.Get("Accept-Encoding"), encoding)
+}
+
+// decodeForClient decodes an upstream-encoded body for a client that does
+// not accept its Content-Encoding and adjusts the response headers. It
+// returns false when the body is sent as it is.
+func (h *ProxyHandler) decodeForClient(w http.ResponseWriter, r *http.Request, body io.Reader) (io.ReadCloser, bool) {
+	encoding := w.Header().Get("Content-Encoding")
+	if !needsDecoding(r, encoding) {
+		return nil, false
+	}
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+	weakenETag(w.Header())
+	if r.Method == http.MethodHead {
+		return http.NoBody, true
+	}
+	decoded, _ := h.decoder(encoding, body)
+	return decoded, true
+}
+
+// decodedCopy returns the cached decoded copy of an entry kept in its
+// upstream encoding, if writeDecoded stored one
+func (h *ProxyHandler) decodedCopy(key string, r *http.Request, entry *cache.CachedResponse) (*cache.CachedResponse, bool) {
+	if entry.StoredAt.IsZero() {
+		return nil, false
+	}
+	decoded, found, err := h.derivedCopy(encodedKey(key, entry, h.reqHeaders.Filter(r.Header), "identity"))
+	return decoded, err == nil && found
+}
+
+// writeDecoded streams an entry kept in its upstream encoding to a client
+// that does not accept it, decoding it on the fly. The decoded body is
+// cached next to the entry when it fits the cache entry size limit.
+func (h *ProxyHandler) writeDecoded(w http.ResponseWriter, r *http.Request, key string, entry *cache.CachedResponse, status string) error {
+	copyHeader(w.Header(), entry.Header)
+	w.Header().Set("Content-Type", entry.ContentType)
+	w.Header().Set("X-Cache", status)
+	w.Header().Add("Vary", "Accept-Encoding")
+	decoded, _ := h.decodeForClient(w, r, bytes.NewReader(entry.Data))
+	defer decoded.Close()
+
+	var out io.Writer = w
+	var enc io.WriteCloser
+	if encoding := h.compression.encoding(r, entry.ContentType, -1, w.Header()); encoding != "" && r.Method == http.MethodGet {
+		markEncoded(w.Header(), encoding)
+		enc = h.compression.writer(encoding, w)
+		out = enc
+	}
+	w.WriteHeader(entry.Status())
+	if r.Method == http.MethodHead {
+		return nil
+	}
+
+	data, buffered, err := h.stream(out, decoded, !entry.StoredAt.IsZero())
+	if enc != nil && err == nil {
+		enc.Close()
+	}
+	if err != nil || !buffered {
+		return err
+	}
+
+	copied := *entry
+	copied.Data = data
+	copied.Header = entry.Header.Clone()
+	copied.Header.Del("Content-Encoding")
+	weakenETag(copied.Header)
+	if copied.ETag != "" && !strings.HasPrefix(copied.ETag, "W/") {
+		copied.ETag = "W/" + copied.ETag
+	}
+	copied.Vary, copied.Variants = nil, nil
+	_ = h.cache.Set(encodedKey(key, entry, h.reqHeaders.Filter(r.Header), "identity"), &copied)
+	return nil
+}
+
+// decodedBody fails reads with ErrDecodedTooBig once more than the limit
+// has been decoded, guarding against decompression bombs
+type decodedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *decodedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrDecodedTooBig
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+	n = int(b.remaining)
+	b.remaining = -1
+	return n, ErrDecodedTooBig
+}
+
+// errorReader fails every read
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) { return 0, r.err }
+
+// cappedBuffer keeps what is written to it until it grows past max
+type cappedBuffer struct {
+	bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.max > 0 && int64(b.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
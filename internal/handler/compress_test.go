@@ -0,0 +1,353 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/harold/proxy-harold/internal/cache"
+	"github.com/harold/proxy-harold/internal/proxy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := map[string]string{
+		"":                            "",
+		"identity":                    "",
+		"gzip":                        "gzip",
+		"x-gzip":                      "gzip",
+		"gzip, deflate, br, zstd":     "br",
+		"gzip, zstd":                  "zstd",
+		"br;q=0.5, gzip":              "gzip",
+		"GZIP;q=0.8, zstd;q=0.8":      "zstd",
+		"*":                           "br",
+		"*;q=0.5, br;q=0, gzip;q=0.1": "zstd",
+		"br;q=0":                      "",
+		"gzip;q=bogus":                "",
+	}
+
+	for accept, want := range tests {
+		if got := negotiateEncoding(accept); got != want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", accept, got, want)
+		}
+	}
+}
+
+func decode(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("bad gzip body: %v", err)
+		}
+		r = gz
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("bad zstd body: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(body)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decode %s: %v", encoding, err)
+	}
+	return string(data)
+}
+
+func TestHandler_CompressesResponses(t *testing.T) {
+	payload := strings.Repeat(`{"id":1,"name":"item"},`, 200)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		switch r.URL.Path {
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{}`))
+			return
+		default:
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write([]byte(payload))
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(5*time.Second, 1<<20), WithCompression(0, 1024))
+
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/?url="+server.URL+path, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, step := range []struct{ accept, encoding, cache string }{
+		{"gzip", "gzip", "MISS"},
+		{"br, gzip", "br", "HIT"},
+		{"zstd", "zstd", "HIT"},
+		{"br", "br", "HIT"},
+		{"", "", "HIT"},
+	} {
+		rec := get("/data", step.accept)
+		if got := rec.Header().Get("Content-Encoding"); got != step.encoding {
+			t.Errorf("%q: expected encoding %q, got %q", step.accept, step.encoding, got)
+		}
+		if got := rec.Header().Get("X-Cache"); got != step.cache {
+			t.Errorf("%q: expected X-Cache %s, got %s", step.accept, step.cache, got)
+		}
+		if !strings.Contains(rec.Header().Get("Vary"), "Accept-Encoding") {
+			t.Errorf("%q: expected Vary: Accept-Encoding, got %q", step.accept, rec.Header().Get("Vary"))
+		}
+		if body := decode(t, step.encoding, rec.Body.Bytes()); body != payload {
+			t.Errorf("%q: body changed", step.accept)
+		}
+		if step.encoding != "" && rec.Header().Get("ETag") != `W/"v1"` {
+			t.Errorf("%q: expected a weak ETag, got %q", step.accept, rec.Header().Get("ETag"))
+		}
+	}
+
+	// The entry and its brotli and zstd copies
+	if n := len(mockC.entries); n != 3 {
+		t.Errorf("expected 3 cache entries, got %d", n)
+	}
+
+	for _, path := range []string{"/image", "/small"} {
+		rec := get(path, "gzip")
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Errorf("%s: expected no compression, got %q", path, got)
+		}
+	}
+}
+
+func TestHandler_CountsCompressedHitsOnce(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(strings.Repeat(`{"id":1},`, 200)))
+	}))
+	defer server.Close()
+
+	disk, err := cache.NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	tiered := cache.NewTieredCache(disk, 1<<20)
+	defer tiered.Close()
+	h := NewProxyHandler(tiered, newTestFetcher(5*time.Second, 1<<20), WithCompression(0, 1024))
+
+	for _, accept := range []string{"gzip", "br", "br"} {
+		req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The brotli copy is looked up on each hit, but only the entry counts
+	if stats := tiered.TierStats(); stats.Misses != 1 || stats.MemoryHits != 2 || stats.DiskHits != 0 {
+		t.Errorf("expected 1 miss and 2 memory hits, got %+v", stats)
+	}
+}
+
+func TestHandler_PassesEncodedBodiesThrough(t *testing.T) {
+	var encoded bytes.Buffer
+	bw := brotli.NewWriter(&encoded)
+	bw.Write([]byte(strings.Repeat("text ", 500)))
+	bw.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(5*time.Second, 1<<20), WithCompression(0, 1024))
+
+	for _, want := range []string{"MISS", "HIT"} {
+		req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+		req.Header.Set("Accept-Encoding", "br, gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Header().Get("X-Cache") != want || rec.Header().Get("Content-Encoding") != "br" {
+			t.Errorf("expected %s with the upstream encoding, got %v", want, rec.Header())
+		}
+		if !bytes.Equal(rec.Body.Bytes(), encoded.Bytes()) {
+			t.Errorf("%s: expected the upstream bytes untouched", want)
+		}
+	}
+}
+
+// newEncodingFetcher returns a test fetcher that keeps upstream encodings
+func newEncodingFetcher() *proxy.Fetcher {
+	policy, err := proxy.NewDestinationPolicy([]string{"127.0.0.0/8", "::1/128"}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return proxy.NewFetcher(5*time.Second, 10<<20, proxy.WithDestinationPolicy(policy), proxy.WithUpstreamEncoding(true))
+}
+
+// gzipServer serves body gzip-encoded to requests that accept it
+func gzipServer(body []byte) *httptest.Server {
+	var encoded bytes.Buffer
+	gz := gzip.NewWriter(&encoded)
+	gz.Write(body)
+	gz.Close()
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(encoded.Bytes())
+			return
+		}
+		w.Write(body)
+	}))
+}
+
+func TestHandler_DecodesUpstreamEncodingForClients(t *testing.T) {
+	plain := strings.Repeat("upstream text ", 200)
+	server := gzipServer([]byte(plain))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		accept string
+		cache  string
+		want   string
+	}{
+		{"miss without gzip is decoded", "", "MISS", ""},
+		{"hit with gzip is passed through", "gzip", "HIT", "gzip"},
+		{"hit without gzip is decoded", "br", "HIT", ""},
+		{"decoded copy is reused", "identity", "HIT", ""},
+	}
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newEncodingFetcher())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Header().Get("X-Cache") != tt.cache || rec.Header().Get("Content-Encoding") != tt.want {
+				t.Fatalf("expected %s with encoding %q, got %v", tt.cache, tt.want, rec.Header())
+			}
+			if rec.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("expected Vary: Accept-Encoding, got %q", rec.Header().Get("Vary"))
+			}
+
+			body := rec.Body.String()
+			if tt.want == "gzip" {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatalf("expected a gzip body: %v", err)
+				}
+				decoded, _ := io.ReadAll(gz)
+				body = string(decoded)
+			} else if rec.Header().Get("ETag") != `W/"v1"` {
+				t.Errorf("expected a weak ETag on the decoded body, got %q", rec.Header().Get("ETag"))
+			}
+			if body != plain {
+				t.Errorf("unexpected body of %d bytes", len(body))
+			}
+		})
+	}
+
+	// The entry and its decoded copy
+	if len(mockC.entries) != 2 {
+		t.Errorf("expected 2 cache entries, got %d", len(mockC.entries))
+	}
+}
+
+func TestHandler_LimitsDecodedSize(t *testing.T) {
+	server := gzipServer(make([]byte, 1<<20))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newEncodingFetcher(), WithMaxDecodedSize(64*1024))
+	proxyServer := httptest.NewServer(h)
+	defer proxyServer.Close()
+
+	get := func(accept string) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", proxyServer.URL+"/?url="+server.URL, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	if _, err := get("identity"); err == nil {
+		t.Error("expected decoding a miss past the limit to break the response")
+	}
+	if len(mockC.entries) != 0 {
+		t.Error("expected the aborted response not to be cached")
+	}
+
+	if resp, err := get("gzip"); err != nil || resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected the encoded body for a gzip client, got %v", err)
+	}
+	if _, err := get("identity"); err == nil {
+		t.Error("expected decoding a hit past the limit to break the response")
+	}
+	if len(mockC.entries) != 1 {
+		t.Errorf("expected only the encoded entry to be cached, got %d entries", len(mockC.entries))
+	}
+
+	if h.Aborted() != 2 {
+		t.Errorf("expected 2 aborted responses, got %d", h.Aborted())
+	}
+}
+
+func TestHandler_CachesDecodedCopiesWithinEntryLimit(t *testing.T) {
+	plain := strings.Repeat("a", 64*1024)
+	server := gzipServer([]byte(plain))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newEncodingFetcher(), WithMaxCacheEntrySize(4*1024))
+
+	for i, accept := range []string{"gzip", "identity", "identity"} {
+		req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+		req.Header.Set("Accept-Encoding", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if i > 0 && (rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != plain) {
+			t.Errorf("request %d: expected the decoded body from cache, got %s with %d bytes", i, rec.Header().Get("X-Cache"), rec.Body.Len())
+		}
+	}
+
+	// The encoded body fits, the decoded one does not
+	if len(mockC.entries) != 1 {
+		t.Errorf("expected only the encoded entry to be cached, got %d entries", len(mockC.entries))
+	}
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+
+	"github.com/harold/proxy-harold/internal/auth"
+)
+
+// KeyAdminHandler serves /admin/keys for managing API keys. It uses the
+// same bearer token as the cache admin API.
+type KeyAdminHandler struct {
+	store auth.Store
+	auth  *auth.Authenticator
+	token string
+}
+
+// NewKeyAdminHandler creates a key admin handler. The authenticator, if
+// set, supplies today's usage for each key.
+func NewKeyAdminHandler(store auth.Store, authenticator *auth.Authenticator, token string) *KeyAdminHandler {
+	return &KeyAdminHandler{
+		store: store,
+		auth:  authenticator,
+		token: token,
+	}
+}
+
+// KeyInfo is an API key with its usage for the current day
+type KeyInfo struct {
+	*auth.Key
+	Usage *auth.Usage `json:"usage,omitempty"`
+}
+
+// ServeHTTP handles:
+//
+//	GET    /admin/keys            list keys with today's usage
+//	POST   /admin/keys            create or replace a key from a JSON body;
+//	                              an empty "key" generates a new secret
+//	DELETE /admin/keys?key=<key>  delete a key
+func (h *KeyAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, h.token) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.list(w)
+	case http.MethodPost:
+		h.put(w, r)
+	case http.MethodDelete:
+		h.delete(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *KeyAdminHandler) list(w http.ResponseWriter) {
+	keys, err := h.store.List()
+	if err != nil {
+		writeError(w, "failed to list keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	infos := make([]KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		info := KeyInfo{Key: key}
+		if h.auth != nil {
+			usage := h.auth.Usage(key.Key)
+			info.Usage = &usage
+		}
+		infos = append(infos, info)
+	}
+	sendJSON(w, infos, http.StatusOK)
+}
+
+func (h *KeyAdminHandler) put(w http.ResponseWriter, r *http.Request) {
+	var key auth.Key
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&key); err != nil {
+		writeError(w, "invalid key JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if key.Key == "" {
+		key.Key = rand.Text()
+		status = http.StatusCreated
+	} else if _, found, err := h.store.Get(key.Key); err == nil && !found {
+		status = http.StatusCreated
+	}
+
+	if err := h.store.Put(&key); err != nil {
+		writeError(w, "failed to store key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sendJSON(w, key, status)
+}
+
+func (h *KeyAdminHandler) delete(w http.ResponseWriter, r *http.Request) {
+	secret := r.URL.Query().Get("key")
+	if secret == "" {
+		writeError(w, "missing required 'key' parameter", http.StatusBadRequest)
+		return
+	}
+
+	_, found, err := h.store.Get(secret)
+	if err == nil && !found {
+		writeError(w, "unknown key", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = h.store.Delete(secret)
+	}
+	if err != nil {
+		writeError(w, "failed to delete key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/harold/proxy-harold/internal/auth"
+)
+
+func TestKeyAdmin_ManagesKeys(t *testing.T) {
+	store, err := auth.NewFileStore(t.TempDir() + "/keys.json")
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	h := NewKeyAdminHandler(store, auth.NewAuthenticator(store), "secret")
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Creating without a secret generates one
+	rec := do("POST", "/admin/keys", `{"name":"frontend","daily_requests":100}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rec.Code, rec.Body)
+	}
+	var created auth.Key
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.Key == "" || created.DailyRequests != 100 {
+		t.Fatalf("unexpected key: %+v", created)
+	}
+
+	// Posting an existing secret replaces it
+	rec = do("POST", "/admin/keys", `{"key":"`+created.Key+`","name":"renamed"}`)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200 for update, got %d", rec.Code)
+	}
+
+	rec = do("GET", "/admin/keys", "")
+	var keys []KeyInfo
+	json.NewDecoder(rec.Body).Decode(&keys)
+	if len(keys) != 1 || keys[0].Name != "renamed" || keys[0].Usage == nil {
+		t.Errorf("unexpected key list: %s", rec.Body)
+	}
+
+	if rec := do("DELETE", "/admin/keys?key="+created.Key, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", rec.Code)
+	}
+	if rec := do("DELETE", "/admin/keys?key="+created.Key, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for deleted key, got %d", rec.Code)
+	}
+	if rec := do("POST", "/admin/keys", `not json`); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid JSON, got %d", rec.Code)
+	}
+}
+
+func TestKeyAdmin_RequiresToken(t *testing.T) {
+	store, _ := auth.NewFileStore(t.TempDir() + "/keys.json")
+	h := NewKeyAdminHandler(store, nil, "secret")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/keys", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rec.Code)
+	}
+}
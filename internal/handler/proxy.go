@@ -1,114 +1,874 @@
 package handler
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/harold/proxy-harold/internal/auth"
 	"github.com/harold/proxy-harold/internal/cache"
+	"github.com/harold/proxy-harold/internal/httperror"
 	"github.com/harold/proxy-harold/internal/proxy"
 )
 
 // Cache interface for dependency injection
 type Cache interface {
-	Get(url string) (data []byte, contentType string, found bool, err error)
-	Set(url string, data []byte, contentType string) error
+	Get(url string) (*cache.CachedResponse, bool, error)
+	Set(url string, response *cache.CachedResponse) error
 	Delete(url string) error
 	Close() error
+	// GetVariant and SetVariant select among the variants of responses
+	// that vary on request headers
+	GetVariant(url string, header http.Header) (*cache.CachedResponse, bool, error)
+	SetVariant(url string, vary []string, header http.Header, response *cache.CachedResponse) error
 }
 
 // ProxyHandler handles HTTP proxy requests
 type ProxyHandler struct {
-	cache   Cache
-	fetcher *proxy.Fetcher
+	cache           Cache
+	fetcher         *proxy.Fetcher
+	flights         *coalescer
+	maxEntrySize    int64
+	maxBodySize     int64
+	reqHeaders      *proxy.HeaderPolicy
+	respHeaders     *proxy.HeaderPolicy
+	cacheable       map[int]bool
+	negativeTTL     time.Duration
+	negativeTTLs    map[int]time.Duration
+	staleRevalidate time.Duration
+	staleIfError    time.Duration
+	compression     *compressor
+	maxDecodedSize  int64
+	keys            *cache.KeyNormalizer
+	coalesced       atomic.Int64
+	aborted         atomic.Int64
+}
+
+// Option configures a ProxyHandler
+type Option func(*ProxyHandler)
+
+// WithMaxCacheEntrySize sets the largest body that is buffered for caching
+// and shared between coalesced requests. Larger bodies are only streamed.
+func WithMaxCacheEntrySize(n int64) Option {
+	return func(h *ProxyHandler) {
+		h.maxEntrySize = n
+	}
+}
+
+// WithMaxRequestBodySize limits the request body forwarded upstream
+func WithMaxRequestBodySize(n int64) Option {
+	return func(h *ProxyHandler) {
+		h.maxBodySize = n
+	}
+}
+
+// WithHeaderPolicies sets which request headers are forwarded upstream and
+// which response headers are passed back to the client
+func WithHeaderPolicies(request, response *proxy.HeaderPolicy) Option {
+	return func(h *ProxyHandler) {
+		h.reqHeaders = request
+		h.respHeaders = response
+	}
+}
+
+// DefaultCacheableStatuses are the upstream status codes cached by default
+var DefaultCacheableStatuses = []int{
+	http.StatusOK,
+	http.StatusNonAuthoritativeInfo,
+	http.StatusMovedPermanently,
+	http.StatusNotFound,
+	http.StatusGone,
+}
+
+// WithCacheableStatuses sets which upstream status codes may be cached.
+// 5xx responses are never cached.
+func WithCacheableStatuses(codes []int) Option {
+	return func(h *ProxyHandler) {
+		h.cacheable = make(map[int]bool, len(codes))
+		for _, code := range codes {
+			if code < http.StatusInternalServerError {
+				h.cacheable[code] = true
+			}
+		}
+	}
+}
+
+// WithNegativeTTL caps how long 4xx responses are cached. perStatus
+// overrides the default for individual status codes. A zero TTL disables
+// caching for the affected statuses.
+func WithNegativeTTL(defaultTTL time.Duration, perStatus map[int]time.Duration) Option {
+	return func(h *ProxyHandler) {
+		h.negativeTTL = defaultTTL
+		h.negativeTTLs = perStatus
+	}
+}
+
+// WithStaleWindows sets how long expired entries are served while they are
+// refreshed in the background (stale-while-revalidate) and when upstream
+// fails with a 5xx or network error (stale-if-error). Upstream
+// Cache-Control extensions of the same names take precedence.
+func WithStaleWindows(whileRevalidate, ifError time.Duration) Option {
+	return func(h *ProxyHandler) {
+		h.staleRevalidate = whileRevalidate
+		h.staleIfError = ifError
+	}
+}
+
+// WithKeyNormalizer normalizes target URLs before they are used as cache
+// keys. Without it the raw URL is the key.
+func WithKeyNormalizer(n *cache.KeyNormalizer) Option {
+	return func(h *ProxyHandler) {
+		h.keys = n
+	}
 }
 
 // NewProxyHandler creates a new proxy handler
-func NewProxyHandler(c Cache, f *proxy.Fetcher) *ProxyHandler {
-	return &ProxyHandler{
-		cache:   c,
-		fetcher: f,
+func NewProxyHandler(c Cache, f *proxy.Fetcher, opts ...Option) *ProxyHandler {
+	h := &ProxyHandler{
+		cache:       c,
+		fetcher:     f,
+		flights:     newCoalescer(),
+		maxBodySize: 1024 * 1024,
+		reqHeaders:  proxy.DefaultRequestHeaderPolicy(),
+		respHeaders: proxy.DefaultResponseHeaderPolicy(),
+		negativeTTL: 5 * time.Minute,
+
+		maxDecodedSize: DefaultMaxDecodedSize,
+	}
+	WithCacheableStatuses(DefaultCacheableStatuses)(h)
+	for _, opt := range opts {
+		opt(h)
 	}
+	return h
 }
 
 // ErrorResponse represents a JSON error response
-type ErrorResponse struct {
-	Error string `json:"error"`
-	Code  int    `json:"code"`
-}
+type ErrorResponse = httperror.Response
 
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Set CORS headers for all responses
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "*")
-	w.Header().Set("Access-Control-Max-Age", "86400")
-
-	// Handle preflight requests
-	if r.Method == "OPTIONS" {
+	// CORS is handled by cors.Policy in front of the handler; a bare
+	// OPTIONS request has nothing to proxy
+	if r.Method == http.MethodOptions {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	// Get URL parameter
-	targetURL := r.URL.Query().Get("url")
-	if targetURL == "" {
-		h.sendError(w, "missing required 'url' parameter", http.StatusBadRequest)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		h.sendError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get the target from the url parameter or the path
+	targetURL, err := parseTarget(r)
+	if err != nil {
+		h.sendError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// Validate URL
 	if err := h.fetcher.ValidateURL(targetURL); err != nil {
-		h.sendError(w, err.Error(), http.StatusBadRequest)
+		h.sendError(w, err.Error(), validationStatus(err))
 		return
 	}
 
-	// Check cache first
-	if data, contentType, found, err := h.cache.Get(targetURL); err == nil && found {
-		w.Header().Set("Content-Type", contentType)
-		w.Header().Set("X-Cache", "HIT")
-		w.Write(data)
+	// API keys may be limited to certain destinations
+	if key, ok := auth.FromContext(r.Context()); ok && !key.AllowsHost(hostname(targetURL)) {
+		h.sendError(w, "destination host not allowed for this API key", http.StatusForbidden)
 		return
 	}
 
-	// Fetch from upstream
-	resp, err := h.fetcher.Fetch(targetURL)
+	// Unsafe methods always go straight upstream
+	if !isSafeMethod(r.Method) {
+		h.servePassthrough(w, r, targetURL)
+		return
+	}
+
+	// Serve fresh entries straight from cache
+	upstreamReq := h.upstreamRequest(r, targetURL)
+	key := h.cacheKey(targetURL, upstreamReq.Header)
+	cached, found, err := h.cache.GetVariant(key, upstreamReq.Header)
 	if err != nil {
-		h.sendError(w, "failed to fetch URL: "+err.Error(), http.StatusBadGateway)
+		found = false
+	}
+	now := time.Now()
+	if found && cached.IsFresh(now) {
+		h.finishStream(w, h.writeCached(w, r, key, cached, "HIT"))
 		return
 	}
-	defer resp.Body.Close()
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	// Recently expired entries are served while a refresh runs in the
+	// background
+	if found && cached.CanServeStale(now) && !hasCredentials(upstreamReq.Header) {
+		err := h.writeCached(w, r, key, cached, "STALE")
+		h.refreshInBackground(key, flightKey(key, cached, upstreamReq.Header), upstreamReq, cached)
+		h.finishStream(w, err)
+		return
+	}
+
+	// HEAD is answered from cached metadata when possible, otherwise it is
+	// forwarded without downloading a body into the cache. Ranges are cut
+	// from cached bodies, but partial content from upstream is never
+	// cached.
+	if r.Method == http.MethodHead || upstreamReq.Header.Get("Range") != "" {
+		h.servePassthrough(w, r, targetURL)
+		return
+	}
+
+	// Coalesce concurrent misses for the same URL into one upstream request.
+	// Requests carrying credentials get their own fetch.
+	var f *flight
+	leader := false
+	fk := flightKey(key, cached, upstreamReq.Header)
+	if !hasCredentials(upstreamReq.Header) {
+		f, leader = h.flights.join(fk)
+	}
+	if leader {
+		f.header = upstreamReq.Header
+	}
+	if f != nil && !leader {
+		select {
+		case <-f.done:
+			// The leader may fail to send a shared entry to its own client
+			if f.err != nil && f.entry == nil {
+				h.sendFetchError(w, f.err)
+				return
+			}
+			if f.entry != nil && f.matches(key, upstreamReq.Header) {
+				h.coalesced.Add(1)
+				h.finishStream(w, h.writeCached(w, r, key, f.entry, "COALESCED"))
+				return
+			}
+			// The response was too large to share or is another variant,
+			// fetch it independently
+		case <-r.Context().Done():
+			// The shared fetch carries on for the remaining waiters
+			if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+				h.sendError(w, "timed out waiting for upstream", http.StatusGatewayTimeout)
+			}
+			return
+		}
+	}
+
+	entry, err := h.serveUpstream(w, r, key, upstreamReq, cached, found)
+	if leader {
+		// Losing our own client says nothing about upstream; the waiting
+		// requests fetch for themselves instead
+		flightErr := err
+		if errors.Is(err, errClientGone) {
+			flightErr = nil
+		}
+		h.flights.finish(fk, f, entry, flightErr)
+	}
+	h.finishStream(w, err)
+}
+
+// servePassthrough forwards a request upstream without using the cache.
+// Successful unsafe requests invalidate the cached entry for the URL.
+func (h *ProxyHandler) servePassthrough(w http.ResponseWriter, r *http.Request, targetURL string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBodySize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			h.sendError(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		h.sendError(w, "failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Nothing else waits on a passthrough request, so it ends with the
+	// client's
+	upstreamReq := h.upstreamRequest(r, targetURL)
+	upstreamReq.Context = r.Context()
+	if len(body) > 0 {
+		upstreamReq.Body = bytes.NewReader(body)
+	}
+
+	resp, err := h.fetcher.Do(upstreamReq)
 	if err != nil {
-		h.sendError(w, "failed to read response: "+err.Error(), http.StatusBadGateway)
+		if !isSafeMethod(r.Method) && r.Context().Err() != nil {
+			// Upstream may have acted on a request the client gave up on
+			h.invalidate(targetURL)
+		}
+		h.sendFetchError(w, err)
 		return
 	}
+	defer resp.Body.Close()
+
+	if !isSafeMethod(r.Method) && resp.StatusCode < http.StatusBadRequest {
+		h.invalidate(targetURL)
+	}
 
-	contentType := resp.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "application/octet-stream"
+	cacheStatus := "BYPASS"
+	if r.Method == http.MethodHead {
+		cacheStatus = "MISS"
 	}
 
-	// Cache the response
-	_ = h.cache.Set(targetURL, body, contentType)
+	copyHeader(w.Header(), h.respHeaders.Filter(resp.Header))
+	copyRepresentationHeaders(w.Header(), resp.Header)
+	w.Header().Set("Content-Type", responseContentType(resp))
+	w.Header().Set("X-Cache", cacheStatus)
+	if r.Method == http.MethodHead && resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	var respBody io.Reader = resp.Body
+	if decoded, ok := h.decodeForClient(w, r, resp.Body); ok {
+		defer decoded.Close()
+		respBody = decoded
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	_, _, err = h.stream(w, respBody, false)
+	h.finishStream(w, err)
+}
+
+// upstreamRequest builds the upstream request with the forwarded headers
+func (h *ProxyHandler) upstreamRequest(r *http.Request, targetURL string) *proxy.Request {
+	return &proxy.Request{
+		Method: r.Method,
+		URL:    targetURL,
+		Header: h.reqHeaders.Filter(r.Header),
+	}
+}
 
-	// Send response
+// hasCredentials reports whether forwarded headers identify the client
+func hasCredentials(header http.Header) bool {
+	return header.Get("Authorization") != "" || header.Get("Cookie") != ""
+}
+
+// finishStream reports an error from serving an upstream response
+func (h *ProxyHandler) finishStream(w http.ResponseWriter, err error) {
+	if err == nil {
+		return
+	}
+
+	var abort *streamAbort
+	if errors.As(err, &abort) {
+		// Headers are already sent; abort the connection so the
+		// client cannot mistake a truncated body for a complete one
+		panic(http.ErrAbortHandler)
+	}
+	h.sendFetchError(w, err)
+}
+
+// errClientGone aborts a stream whose client went away
+var errClientGone = errors.New("client disconnected")
+
+// streamAbort reports a failure after the response headers were sent
+type streamAbort struct {
+	err error
+}
+
+func (e *streamAbort) Error() string { return "response aborted: " + e.err.Error() }
+func (e *streamAbort) Unwrap() error { return e.err }
+
+// serveUpstream revalidates a stale entry that carries validators, or
+// fetches the URL from scratch, and streams the result to the client.
+// It returns the complete response when it was small enough to buffer,
+// with an error if only sending it to this client failed.
+func (h *ProxyHandler) serveUpstream(w http.ResponseWriter, r *http.Request, key string, upstreamReq *proxy.Request, cached *cache.CachedResponse, found bool) (*cache.CachedResponse, error) {
+	// The proxy manages conditional requests for its own cache
+	upstreamReq.SetValidators("", "")
+	if found && cached.HasValidators() {
+		upstreamReq.SetValidators(cached.ETag, cached.LastModified)
+	}
+
+	resp, err := h.fetcher.Do(upstreamReq)
+	if err != nil {
+		if found && servesStaleOnError(err) && cached.CanServeOnError(time.Now()) {
+			return cached, h.writeCached(w, r, key, cached, "STALE")
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if found && resp.StatusCode >= http.StatusInternalServerError && cached.CanServeOnError(time.Now()) {
+		return cached, h.writeCached(w, r, key, cached, "STALE")
+	}
+
+	credentialed := hasCredentials(upstreamReq.Header)
+	if found && resp.StatusCode == http.StatusNotModified {
+		h.refresh(key, upstreamReq, cached, resp.Header, credentialed)
+		return cached, h.writeCached(w, r, key, cached, "REVALIDATED")
+	}
+
+	header := h.respHeaders.Filter(resp.Header)
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+		// Encoded bodies are stored and passed on untouched
+		header.Set("Content-Encoding", encoding)
+	}
+	contentType := responseContentType(resp)
+	copyHeader(w.Header(), header)
+	copyRepresentationHeaders(w.Header(), resp.Header)
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("X-Cache", "MISS")
-	w.Write(body)
+
+	// A body kept in its upstream encoding is cached as it is and decoded
+	// on the fly for clients that do not accept it
+	var upstreamBody io.Reader = resp.Body
+	var body io.Reader = resp.Body
+	var raw *cappedBuffer
+	size := resp.ContentLength
+	if header.Get("Content-Encoding") != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		raw = &cappedBuffer{max: h.maxEntrySize}
+		upstreamBody = io.TeeReader(resp.Body, raw)
+		if decoded, ok := h.decodeForClient(w, r, upstreamBody); ok {
+			defer decoded.Close()
+			body, size = decoded, -1
+		} else {
+			body, raw = resp.Body, nil
+		}
+	}
+
+	// The client gets a compressed stream, the cache the original body
+	var out io.Writer = w
+	var enc io.WriteCloser
+	if h.compression.applies(contentType, size, w.Header()) {
+		if raw == nil {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		if encoding := h.compression.encoding(r, contentType, size, w.Header()); encoding != "" && r.Method == http.MethodGet {
+			markEncoded(w.Header(), encoding)
+			enc = h.compression.writer(encoding, w)
+			out = enc
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	buffer := h.maxEntrySize <= 0 || resp.ContentLength <= h.maxEntrySize
+	data, buffered, err := h.stream(out, body, buffer && raw == nil)
+	if enc != nil && err == nil {
+		enc.Close()
+	}
+	if raw != nil && err == nil {
+		// The decoder may stop short of the end of the encoded stream
+		if _, err = io.Copy(io.Discard, upstreamBody); err != nil {
+			err = &streamAbort{err: err}
+		}
+		data, buffered = raw.Bytes(), buffer && !raw.overflow
+	}
+	if err != nil || !buffered {
+		return nil, err
+	}
+
+	// Cookies are specific to one client and never stored
+	header.Del("Set-Cookie")
+	entry := &cache.CachedResponse{
+		StatusCode:   resp.StatusCode,
+		Data:         data,
+		ContentType:  contentType,
+		Header:       header,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	// Cache the response for as long as upstream allows
+	h.store(key, upstreamReq, entry, resp.Header, credentialed)
+
+	return entry, nil
+}
+
+// refreshInBackground refetches a stale entry after it was served, unless
+// a fetch for it is already in flight
+func (h *ProxyHandler) refreshInBackground(key, fk string, upstreamReq *proxy.Request, cached *cache.CachedResponse) {
+	f, leader := h.flights.join(fk)
+	if !leader {
+		return
+	}
+	f.header = upstreamReq.Header
+
+	// HEAD and range requests still refresh the whole entry, and the
+	// client's own preconditions do not apply to it
+	upstreamReq.Method = http.MethodGet
+	upstreamReq.Header = upstreamReq.Header.Clone()
+	for _, name := range []string{"Range", "If-Range", "If-Match", "If-Unmodified-Since"} {
+		upstreamReq.Header.Del(name)
+	}
+	r := &http.Request{Method: http.MethodGet}
+	go func() {
+		entry, err := h.serveUpstream(discardWriter{header: make(http.Header)}, r, key, upstreamReq, cached, true)
+		h.flights.finish(fk, f, entry, err)
+	}()
+}
+
+// servesStaleOnError reports whether a fetch error may be answered with a
+// stale entry. Destinations that are no longer allowed never are.
+func servesStaleOnError(err error) bool {
+	return !errors.Is(err, proxy.ErrBlockedDestination) && !errors.Is(err, proxy.ErrDeniedHost)
+}
+
+// discardWriter is the response writer of background refreshes
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+// stream copies the upstream body to the client, optionally buffering it
+// for the cache. Buffering stops once the body exceeds the cache entry size
+// limit, in which case buffered is false. If the client goes away the
+// body is still read to completion while it can be buffered.
+func (h *ProxyHandler) stream(w io.Writer, body io.Reader, buffer bool) ([]byte, bool, error) {
+	var buf *bytes.Buffer
+	if buffer {
+		buf = new(bytes.Buffer)
+	}
+
+	chunk := make([]byte, 32*1024)
+	clientGone := false
+	for {
+		n, readErr := body.Read(chunk)
+		if n > 0 {
+			if !clientGone {
+				if _, err := w.Write(chunk[:n]); err != nil {
+					clientGone = true
+				}
+			}
+			if buf != nil {
+				if h.maxEntrySize > 0 && int64(buf.Len()+n) > h.maxEntrySize {
+					buf = nil
+				} else {
+					buf.Write(chunk[:n])
+				}
+			}
+			if clientGone && buf == nil {
+				return nil, false, &streamAbort{err: errClientGone}
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			if errors.Is(readErr, proxy.ErrResponseTooBig) || errors.Is(readErr, ErrDecodedTooBig) {
+				h.aborted.Add(1)
+			}
+			return nil, false, &streamAbort{err: readErr}
+		}
+	}
+
+	if buf == nil {
+		return nil, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// Coalesced returns how many requests were served from another request's fetch
+func (h *ProxyHandler) Coalesced() int64 {
+	return h.coalesced.Load()
+}
+
+// Aborted returns how many responses were cut off for exceeding the size limit
+func (h *ProxyHandler) Aborted() int64 {
+	return h.aborted.Load()
+}
+
+// writeCached sends a cached response, omitting the body for HEAD requests.
+// It returns an error when decoding the body failed after the headers
+// were sent.
+func (h *ProxyHandler) writeCached(w http.ResponseWriter, r *http.Request, key string, cached *cache.CachedResponse, status string) error {
+	// Entries kept in their upstream encoding are decoded for clients that
+	// do not accept it, from the decoded copy once there is one
+	upstreamEncoded := cached.Header.Get("Content-Encoding") != ""
+	if needsDecoding(r, cached.Header.Get("Content-Encoding")) {
+		decoded, found := h.decodedCopy(key, r, cached)
+		if !found {
+			return h.writeDecoded(w, r, key, cached, status)
+		}
+		cached = decoded
+	}
+
+	// HEAD describes the uncompressed body
+	compressible := h.compression.applies(cached.ContentType, int64(len(cached.Data)), cached.Header)
+	body, encoding := cached, ""
+	if compressible && r.Method == http.MethodGet {
+		if encoding = h.compression.encoding(r, cached.ContentType, int64(len(cached.Data)), cached.Header); encoding != "" {
+			body = h.encodedCopy(key, r, cached, encoding)
+		}
+	}
+
+	copyHeader(w.Header(), body.Header)
+	w.Header().Set("Content-Type", cached.ContentType)
+	w.Header().Set("X-Cache", status)
+	if compressible || upstreamEncoded {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if encoding != "" {
+		markEncoded(w.Header(), encoding)
+	}
+	if cached.Status() == http.StatusOK {
+		w.Header().Set("Accept-Ranges", "bytes")
+		if encoding == "" && h.writeRanges(w, r, cached) {
+			return nil
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body.Data)))
+	w.WriteHeader(cached.Status())
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	w.Write(body.Data)
+	return nil
+}
+
+// copyHeader adds all values from src to dst
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// copyRepresentationHeaders passes on the headers that describe partial
+// or encoded content, whatever the response header policy
+func copyRepresentationHeaders(dst, src http.Header) {
+	for _, name := range []string{"Accept-Ranges", "Content-Encoding", "Content-Range"} {
+		if value := src.Get(name); value != "" {
+			dst.Set(name, value)
+		}
+	}
+}
+
+// responseContentType returns the upstream content type or a binary default
+func responseContentType(resp *http.Response) string {
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// injectedNamespace prefixes the cache keys of responses fetched with
+// injected credentials. It keeps the key a parseable URL, so host purges
+// still find these entries.
+const injectedNamespace = "injected+"
+
+// cacheKey returns the key a target URL is cached and coalesced under.
+// Host rules may add request header values to it; injected credentials
+// never become part of the key.
+func (h *ProxyHandler) cacheKey(targetURL string, header http.Header) string {
+	key := h.baseKey(targetURL)
+	if rule := h.fetcher.Rule(targetURL); rule != nil && len(rule.KeyHeaders) > 0 {
+		key += keyHeaders(rule.KeyHeaders, header)
+	}
+	return key
+}
+
+// baseKey returns the normalized key of a target URL without header values
+func (h *ProxyHandler) baseKey(targetURL string) string {
+	return targetKey(h.keys, h.fetcher, targetURL)
+}
+
+// targetKey returns the normalized key of a target URL, in the injected
+// namespace if the fetcher injects credentials for it. The proxy and the
+// admin API build keys the same way.
+func targetKey(keys *cache.KeyNormalizer, fetcher *proxy.Fetcher, targetURL string) string {
+	key := targetURL
+	if keys != nil {
+		key = keys.Normalize(targetURL)
+	}
+	if fetcher != nil && fetcher.Injects(targetURL) {
+		return injectedNamespace + key
+	}
+	return key
+}
+
+// keyHeaders encodes request header values as a URL fragment, so the key
+// stays a parseable URL that host and prefix purges still find
+func keyHeaders(names []string, header http.Header) string {
+	values := make(url.Values, len(names))
+	for _, name := range names {
+		values.Set(strings.ToLower(name), strings.Join(header.Values(name), ","))
+	}
+	return "#" + values.Encode()
+}
+
+// flightKey returns the key concurrent requests are coalesced under. Once
+// a URL is known to vary, only requests for the same variant are.
+func flightKey(key string, cached *cache.CachedResponse, header http.Header) string {
+	if cached == nil || len(cached.Vary) == 0 {
+		return key
+	}
+	return cache.VariantURL(key, cached.Vary, header)
+}
+
+// prefixPurger is implemented by caches that can remove entries by prefix
+type prefixPurger interface {
+	PurgePrefix(prefix string) (int, error)
+}
+
+// invalidate removes the cached entries for a target URL, including every
+// variant keyed on request headers
+func (h *ProxyHandler) invalidate(targetURL string) {
+	key := h.baseKey(targetURL)
+	_ = h.cache.Delete(key)
+	if rule := h.fetcher.Rule(targetURL); rule != nil && len(rule.KeyHeaders) > 0 {
+		if purger, ok := h.cache.(prefixPurger); ok {
+			_, _ = purger.PurgePrefix(key + "#")
+		}
+	}
+}
+
+// hostname returns the host of a validated target URL, without port
+func hostname(targetURL string) string {
+	parsed, err := url.Parse(targetURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Hostname()
+}
+
+// isSafeMethod reports whether the method is read-only and may use the cache
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+// store caches a response according to its status, the upstream
+// freshness headers and any host rule TTL. Responses that are already
+// stale are kept only if they can be revalidated, responses to
+// credentialed requests only if upstream marks them shareable, and
+// responses with "Vary: *" never.
+func (h *ProxyHandler) store(key string, upstreamReq *proxy.Request, entry *cache.CachedResponse, header http.Header, credentialed bool) {
+	// A 304 may leave out Vary, the stored variant still knows it. The
+	// fields are recorded even when the response is not stored, so
+	// coalesced requests only share the variant they asked for.
+	vary, ok := cache.VaryFields(header)
+	if !ok {
+		return
+	}
+	if header.Values("Vary") != nil {
+		entry.Vary = vary
+	}
+
+	status := entry.Status()
+	if !h.cacheable[status] || !cache.IsStorable(header) {
+		return
+	}
+	if credentialed && !cache.AllowsAuthorized(header) {
+		return
+	}
+
+	now := time.Now()
+	ttl, fresh := cache.FreshnessLifetime(header, now)
+	if rule := h.fetcher.Rule(upstreamReq.URL); rule != nil && rule.TTL > 0 {
+		// A host rule overrides the lifetime advertised upstream
+		ttl, fresh = time.Duration(rule.TTL), true
+	}
+	if status >= http.StatusBadRequest {
+		// Negative responses are cached for a short, separate lifetime
+		limit := h.negativeTTLFor(status)
+		if limit <= 0 {
+			return
+		}
+		if fresh && (ttl == 0 || ttl > limit) {
+			ttl = limit
+		}
+	}
+
+	entry.StaleWhileRevalidate, entry.StaleIfError = cache.StaleWindows(header, h.staleRevalidate, h.staleIfError)
+
+	switch {
+	case fresh && ttl > 0:
+		entry.ExpiresAt = now.Add(ttl)
+	case fresh:
+		entry.ExpiresAt = time.Time{} // cache default
+	case entry.HasValidators():
+		entry.ExpiresAt = now // stale, revalidate on next use
+	default:
+		return
+	}
+
+	_ = h.cache.SetVariant(key, entry.Vary, upstreamReq.Header, entry)
+}
+
+// negativeTTLFor returns the maximum cache lifetime for a 4xx status
+func (h *ProxyHandler) negativeTTLFor(status int) time.Duration {
+	if ttl, ok := h.negativeTTLs[status]; ok {
+		return ttl
+	}
+	return h.negativeTTL
+}
+
+// refresh extends a cached entry after upstream confirmed it with a 304
+func (h *ProxyHandler) refresh(key string, upstreamReq *proxy.Request, cached *cache.CachedResponse, header http.Header, credentialed bool) {
+	// Headers sent with a 304 replace the stored ones
+	updated := h.respHeaders.Filter(header)
+	updated.Del("Set-Cookie")
+	if cached.Header == nil {
+		cached.Header = make(http.Header)
+	}
+	for name, values := range updated {
+		cached.Header[name] = values
+	}
+
+	if etag := header.Get("ETag"); etag != "" {
+		cached.ETag = etag
+	}
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		cached.LastModified = lastModified
+	}
+
+	// Freshness comes from the stored headers as updated by the 304, so a
+	// bare 304 keeps the lifetime upstream gave the full response
+	merged := cached.Header.Clone()
+	for name, values := range header {
+		merged[name] = values
+	}
+	h.store(key, upstreamReq, cached, merged, credentialed)
+}
+
+// sendFetchError reports an upstream failure to the client
+func (h *ProxyHandler) sendFetchError(w http.ResponseWriter, err error) {
+	for _, denied := range []error{proxy.ErrBlockedDestination, proxy.ErrDeniedHost} {
+		if errors.Is(err, denied) {
+			h.sendError(w, denied.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	h.sendError(w, "failed to fetch URL: "+err.Error(), http.StatusBadGateway)
+}
+
+// validationStatus maps URL validation errors to HTTP status codes
+func validationStatus(err error) int {
+	if errors.Is(err, proxy.ErrBlockedDestination) || errors.Is(err, proxy.ErrDeniedHost) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
 }
 
 // sendError sends a JSON error response
 func (h *ProxyHandler) sendError(w http.ResponseWriter, message string, code int) {
+	writeError(w, message, code)
+}
+
+// writeError sends a JSON error response
+func writeError(w http.ResponseWriter, message string, code int) {
+	httperror.Write(w, message, code)
+}
+
+// sendJSON writes v as a JSON response
+func sendJSON(w http.ResponseWriter, v any, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	json.NewEncoder(w).Encode(ErrorResponse{
-		Error: message,
-		Code:  code,
-	})
+	json.NewEncoder(w).Encode(v)
 }
 
-// Ensure cache.BadgerCache implements Cache interface
-var _ Cache = (*cache.BadgerCache)(nil)
+// Ensure both cache implementations satisfy the Cache interface
+var (
+	_ Cache = (*cache.BadgerCache)(nil)
+	_ Cache = (*cache.TieredCache)(nil)
+)
@@ -1,46 +1,71 @@
 package handler
 
 import (
+	"context"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/harold/proxy-harold/internal/auth"
 	"github.com/harold/proxy-harold/internal/cache"
 	"github.com/harold/proxy-harold/internal/proxy"
 )
 
 // mockCache implements cache.Cache for testing
 type mockCache struct {
-	data map[string][]byte
-	ct   map[string]string
+	mu      sync.Mutex
+	entries map[string]*cache.CachedResponse
+	// expires records the ExpiresAt requested by the handler, before defaults
+	expires map[string]time.Time
 }
 
 func newMockCache() *mockCache {
 	return &mockCache{
-		data: make(map[string][]byte),
-		ct:   make(map[string]string),
+		entries: make(map[string]*cache.CachedResponse),
+		expires: make(map[string]time.Time),
 	}
 }
 
-func (m *mockCache) Get(url string) ([]byte, string, bool, error) {
+func (m *mockCache) Get(url string) (*cache.CachedResponse, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := cache.GenerateCacheKey(url)
-	data, exists := m.data[key]
-	return data, m.ct[key], exists, nil
+	entry, exists := m.entries[key]
+	if !exists {
+		return nil, false, nil
+	}
+	copied := *entry
+	return &copied, true, nil
 }
 
-func (m *mockCache) Set(url string, data []byte, contentType string) error {
+func (m *mockCache) Set(url string, response *cache.CachedResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := cache.GenerateCacheKey(url)
-	m.data[key] = data
-	m.ct[key] = contentType
+	stored := *response
+	m.expires[key] = stored.ExpiresAt
+	stored.StoredAt = time.Now()
+	if stored.ExpiresAt.IsZero() {
+		stored.ExpiresAt = stored.StoredAt.Add(time.Hour)
+	}
+	m.entries[key] = &stored
 	return nil
 }
 
 func (m *mockCache) Delete(url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	key := cache.GenerateCacheKey(url)
-	delete(m.data, key)
-	delete(m.ct, key)
+	delete(m.entries, key)
+	delete(m.expires, key)
 	return nil
 }
 
@@ -48,8 +73,31 @@ func (m *mockCache) Close() error {
 	return nil
 }
 
+// GetVariant ignores variants; tests of Vary use a real cache
+func (m *mockCache) GetVariant(url string, _ http.Header) (*cache.CachedResponse, bool, error) {
+	return m.Get(url)
+}
+
+func (m *mockCache) SetVariant(url string, _ []string, _ http.Header, response *cache.CachedResponse) error {
+	return m.Set(url, response)
+}
+
+// set is a shorthand for populating the cache in tests
+func (m *mockCache) set(url string, data []byte, contentType string) {
+	m.Set(url, &cache.CachedResponse{Data: data, ContentType: contentType})
+}
+
+// newTestFetcher returns a fetcher that may reach httptest servers on loopback
+func newTestFetcher(timeout time.Duration, maxSize int64) *proxy.Fetcher {
+	policy, err := proxy.NewDestinationPolicy([]string{"127.0.0.0/8", "::1/128"}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return proxy.NewFetcher(timeout, maxSize, proxy.WithDestinationPolicy(policy))
+}
+
 func TestHandler_RequiresURLParameter(t *testing.T) {
-	h := NewProxyHandler(newMockCache(), proxy.NewFetcher(10*time.Second, 10*1024*1024))
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
 
 	req := httptest.NewRequest("GET", "/", nil)
 	rec := httptest.NewRecorder()
@@ -62,7 +110,7 @@ func TestHandler_RequiresURLParameter(t *testing.T) {
 }
 
 func TestHandler_RejectsInvalidURL(t *testing.T) {
-	h := NewProxyHandler(newMockCache(), proxy.NewFetcher(10*time.Second, 10*1024*1024))
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
 
 	req := httptest.NewRequest("GET", "/?url=javascript:alert(1)", nil)
 	rec := httptest.NewRecorder()
@@ -83,7 +131,7 @@ func TestHandler_FetchesAndCaches(t *testing.T) {
 	defer server.Close()
 
 	mockC := newMockCache()
-	h := NewProxyHandler(mockC, proxy.NewFetcher(10*time.Second, 10*1024*1024))
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
 
 	// First request - cache miss
 	req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
@@ -106,19 +154,19 @@ func TestHandler_FetchesAndCaches(t *testing.T) {
 
 	// Verify data was cached
 	key := cache.GenerateCacheKey(server.URL)
-	if _, exists := mockC.data[key]; !exists {
+	if _, exists := mockC.entries[key]; !exists {
 		t.Error("expected data to be cached")
 	}
 }
 
 func TestHandler_ReturnsCachedData(t *testing.T) {
 	mockC := newMockCache()
-	fetcher := proxy.NewFetcher(10*time.Second, 10*1024*1024)
+	fetcher := newTestFetcher(10*time.Second, 10*1024*1024)
 	h := NewProxyHandler(mockC, fetcher)
 
 	// Pre-populate cache
 	testURL := "https://cached.example.com/data"
-	mockC.Set(testURL, []byte(`{"cached":"response"}`), "application/json")
+	mockC.set(testURL, []byte(`{"cached":"response"}`), "application/json")
 
 	req := httptest.NewRequest("GET", "/?url="+testURL, nil)
 	rec := httptest.NewRecorder()
@@ -138,43 +186,715 @@ func TestHandler_ReturnsCachedData(t *testing.T) {
 	}
 }
 
-func TestHandler_SetsCORSHeaders(t *testing.T) {
+func TestHandler_HonorsUpstreamCacheControl(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantCached bool
+		wantTTL    time.Duration
+	}{
+		{"no headers uses default", nil, true, 0},
+		{"max-age", map[string]string{"Cache-Control": "max-age=5"}, true, 5 * time.Second},
+		{"s-maxage wins", map[string]string{"Cache-Control": "max-age=5, s-maxage=60"}, true, 60 * time.Second},
+		{"age is subtracted", map[string]string{"Cache-Control": "max-age=60", "Age": "20"}, true, 40 * time.Second},
+		{"no-store", map[string]string{"Cache-Control": "no-store"}, false, 0},
+		{"no-cache", map[string]string{"Cache-Control": "no-cache"}, false, 0},
+		{"private", map[string]string{"Cache-Control": "private, max-age=60"}, false, 0},
+		{"expired", map[string]string{"Expires": "0"}, false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				w.Write([]byte("data"))
+			}))
+			defer server.Close()
+
+			mockC := newMockCache()
+			h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+			start := time.Now()
+			req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			key := cache.GenerateCacheKey(server.URL)
+			if _, cached := mockC.entries[key]; cached != tt.wantCached {
+				t.Fatalf("cached = %v, want %v", cached, tt.wantCached)
+			}
+			if !tt.wantCached {
+				return
+			}
+
+			expires := mockC.expires[key]
+			if tt.wantTTL == 0 {
+				if !expires.IsZero() {
+					t.Errorf("expected default TTL, got expiry %v", expires)
+				}
+				return
+			}
+			// Allow for the upstream Date header ticking over a second
+			if ttl := expires.Sub(start); ttl > tt.wantTTL+time.Second || ttl < tt.wantTTL-time.Second {
+				t.Errorf("ttl = %v, want %v", ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestHandler_RevalidatesStaleEntries(t *testing.T) {
+	var requests, conditional int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"large":"feed"}`))
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+	// First request stores a stale-but-revalidatable entry
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	if rec.Header().Get("X-Cache") != "MISS" {
+		t.Fatalf("expected X-Cache: MISS, got %s", rec.Header().Get("X-Cache"))
+	}
+
+	// Second request revalidates and serves the cached body
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+	if rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Errorf("expected X-Cache: REVALIDATED, got %s", rec.Header().Get("X-Cache"))
+	}
+	if rec.Body.String() != `{"large":"feed"}` {
+		t.Errorf("unexpected body: %s", rec.Body.String())
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected cached content type, got %s", rec.Header().Get("Content-Type"))
+	}
+	if requests != 2 || conditional != 1 {
+		t.Errorf("expected 2 requests with 1 conditional, got %d and %d", requests, conditional)
+	}
+}
+
+func TestHandler_RevalidationRefreshesTTL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("fresh data"))
+	}))
+	defer server.Close()
+
 	mockC := newMockCache()
-	mockC.Set("https://example.com", []byte("data"), "text/plain")
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
 
-	h := NewProxyHandler(mockC, proxy.NewFetcher(10*time.Second, 10*1024*1024))
+	// Seed an expired entry that has a Last-Modified validator
+	key := cache.GenerateCacheKey(server.URL)
+	mockC.entries[key] = &cache.CachedResponse{
+		Data:         []byte("cached data"),
+		ContentType:  "text/plain",
+		LastModified: "Wed, 01 Jan 2025 00:00:00 GMT",
+		ExpiresAt:    time.Now().Add(-time.Minute),
+	}
 
-	req := httptest.NewRequest("GET", "/?url=https://example.com", nil)
 	rec := httptest.NewRecorder()
-	h.ServeHTTP(rec, req)
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+	if rec.Body.String() != "cached data" {
+		t.Errorf("expected cached body, got %s", rec.Body.String())
+	}
+	if !mockC.entries[key].IsFresh(time.Now()) {
+		t.Error("expected entry to be fresh again after 304")
+	}
+}
+
+func TestHandler_CoalescesConcurrentMisses(t *testing.T) {
+	var upstreamHits atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstreamHits.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		w.Write([]byte("shared"))
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+
+	const clients = 20
+	recs := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+		}(recs[i])
+	}
+
+	// Give every client time to join the in-flight fetch
+	<-started
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
 
-	cors := rec.Header().Get("Access-Control-Allow-Origin")
-	if cors != "*" {
-		t.Errorf("expected CORS header *, got %s", cors)
+	if hits := upstreamHits.Load(); hits != 1 {
+		t.Errorf("expected 1 upstream request, got %d", hits)
 	}
 
-	methods := rec.Header().Get("Access-Control-Allow-Methods")
-	if methods == "" {
-		t.Error("expected Access-Control-Allow-Methods header")
+	var misses, coalesced int
+	for _, rec := range recs {
+		if rec.Body.String() != "shared" {
+			t.Errorf("unexpected body: %s", rec.Body.String())
+		}
+		switch rec.Header().Get("X-Cache") {
+		case "MISS":
+			misses++
+		case "COALESCED":
+			coalesced++
+		}
+	}
+	if misses != 1 || coalesced != clients-1 {
+		t.Errorf("expected 1 MISS and %d COALESCED, got %d and %d", clients-1, misses, coalesced)
+	}
+	if h.Coalesced() != clients-1 {
+		t.Errorf("expected coalesced counter %d, got %d", clients-1, h.Coalesced())
 	}
 }
 
-func TestHandler_HandlesPreflight(t *testing.T) {
-	h := NewProxyHandler(newMockCache(), proxy.NewFetcher(10*time.Second, 10*1024*1024))
+func TestHandler_CoalescedFollowerHonorsDeadline(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("slow"))
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+
+	leader := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.ServeHTTP(leader, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	follower := httptest.NewRecorder()
+	h.ServeHTTP(follower, httptest.NewRequest("GET", "/?url="+server.URL, nil).WithContext(ctx))
+
+	if follower.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected 504 for follower, got %d", follower.Code)
+	}
+
+	// The leader still completes once upstream answers
+	close(release)
+	<-done
+	if leader.Body.String() != "slow" {
+		t.Errorf("unexpected leader body: %s", leader.Body.String())
+	}
+}
+
+// brokenWriter is a client that has gone away
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w brokenWriter) Write([]byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestHandler_CoalescedFollowerSurvivesLeaderDisconnect(t *testing.T) {
+	var upstreamHits atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	body := strings.Repeat("x", 200*1024)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upstreamHits.Add(1) == 1 {
+			close(started)
+			<-release
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024), WithMaxCacheEntrySize(1024))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() { recover() }()
+		h.ServeHTTP(brokenWriter{httptest.NewRecorder()}, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	}()
+	<-started
+
+	follower := httptest.NewRecorder()
+	followerDone := make(chan struct{})
+	go func() {
+		defer close(followerDone)
+		h.ServeHTTP(follower, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-done
+	<-followerDone
+
+	if follower.Code != http.StatusOK || follower.Body.Len() != len(body) {
+		t.Errorf("expected the follower to get the full body, got %d with %d bytes", follower.Code, follower.Body.Len())
+	}
+	if hits := upstreamHits.Load(); hits != 2 {
+		t.Errorf("expected the follower to fetch for itself, got %d upstream requests", hits)
+	}
+}
+
+func TestHandler_PassthroughEndsWithClient(t *testing.T) {
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices a closed connection once the body is read
+		io.ReadAll(r.Body)
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(canceled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	mockC.set(server.URL, []byte("old"), "text/plain")
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/?url="+server.URL, strings.NewReader("x")).WithContext(ctx))
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("expected the upstream request to be canceled with the client")
+	}
+	if _, found, _ := mockC.Get(server.URL); found {
+		t.Error("expected the entry to be invalidated, as upstream may have acted on the request")
+	}
+}
+
+func TestHandler_AbortsOversizedStream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 8; i++ {
+			w.Write([]byte(strings.Repeat("x", 1024)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer upstream.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 4*1024))
+	proxyServer := httptest.NewServer(h)
+	defer proxyServer.Close()
+
+	resp, err := http.Get(proxyServer.URL + "/?url=" + upstream.URL)
+	if err == nil {
+		_, err = io.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Error("expected the client to see a broken response")
+	}
+
+	if h.Aborted() != 1 {
+		t.Errorf("expected 1 aborted response, got %d", h.Aborted())
+	}
+	if len(mockC.entries) != 0 {
+		t.Error("expected truncated response not to be cached")
+	}
+}
+
+func TestHandler_StreamsBodiesLargerThanCacheLimit(t *testing.T) {
+	large := strings.Repeat("y", 64*1024)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(large))
+	}))
+	defer upstream.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024), WithMaxCacheEntrySize(1024))
 
-	req := httptest.NewRequest("OPTIONS", "/?url=https://example.com", nil)
-	req.Header.Set("Origin", "https://somesite.com")
 	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+upstream.URL, nil))
+
+	if rec.Body.String() != large {
+		t.Errorf("expected full body of %d bytes, got %d", len(large), rec.Body.Len())
+	}
+	if len(mockC.entries) != 0 {
+		t.Error("expected body over the cache size limit not to be cached")
+	}
+}
+
+func TestHandler_ForwardsUnsafeMethods(t *testing.T) {
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		t.Run(method, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if r.Method != method {
+					t.Errorf("expected %s upstream, got %s", method, r.Method)
+				}
+				if r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("expected forwarded Content-Type, got %q", r.Header.Get("Content-Type"))
+				}
+				if r.Header.Get("X-Secret") != "" {
+					t.Error("unexpected header forwarded upstream")
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"echo":` + string(body) + `}`))
+			}))
+			defer server.Close()
+
+			mockC := newMockCache()
+			mockC.set(server.URL, []byte("stale"), "text/plain")
+			h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+			req := httptest.NewRequest(method, "/?url="+server.URL, strings.NewReader(`{"a":1}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Secret", "do-not-forward")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
 
+			if rec.Body.String() != `{"echo":{"a":1}}` {
+				t.Errorf("unexpected body: %s", rec.Body.String())
+			}
+			if rec.Header().Get("X-Cache") != "BYPASS" {
+				t.Errorf("expected X-Cache: BYPASS, got %s", rec.Header().Get("X-Cache"))
+			}
+			if len(mockC.entries) != 0 {
+				t.Error("expected successful unsafe request to invalidate the cached entry")
+			}
+		})
+	}
+}
+
+func TestHandler_LimitsRequestBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("oversized body should not reach upstream")
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024), WithMaxRequestBodySize(16))
+
+	req := httptest.NewRequest("POST", "/?url="+server.URL, strings.NewReader(strings.Repeat("x", 17)))
+	rec := httptest.NewRecorder()
 	h.ServeHTTP(rec, req)
 
-	if rec.Code != http.StatusNoContent {
-		t.Errorf("expected 204 for preflight, got %d", rec.Code)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d", rec.Code)
+	}
+}
+
+func TestHandler_HeadFromCache(t *testing.T) {
+	mockC := newMockCache()
+	mockC.set("https://example.com/file", []byte("0123456789"), "text/plain")
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("HEAD", "/?url=https://example.com/file", nil))
+
+	if rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected X-Cache: HIT, got %s", rec.Header().Get("X-Cache"))
+	}
+	if rec.Header().Get("Content-Length") != "10" {
+		t.Errorf("expected Content-Length 10, got %s", rec.Header().Get("Content-Length"))
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("expected empty body for HEAD, got %q", rec.Body.String())
+	}
+}
+
+func TestHandler_HeadMissIsForwarded(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("expected HEAD upstream, got %s", r.Method)
+		}
+		w.Header().Set("Content-Type", "audio/mpeg")
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("HEAD", "/?url="+server.URL, nil))
+
+	if rec.Header().Get("Content-Type") != "audio/mpeg" {
+		t.Errorf("expected upstream Content-Type, got %s", rec.Header().Get("Content-Type"))
+	}
+	if len(mockC.entries) != 0 {
+		t.Error("HEAD responses should not be cached")
+	}
+}
+
+func TestHandler_RejectsUnsupportedMethods(t *testing.T) {
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("TRACE", "/?url=https://example.com", nil))
+
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+}
+
+func TestHandler_ForwardsAllowedRequestHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Language") != "el-GR" {
+			t.Errorf("expected Accept-Language to be forwarded, got %q", r.Header.Get("Accept-Language"))
+		}
+		if r.Header.Get("Cookie") != "" {
+			t.Error("Cookie should not be forwarded by default")
+		}
+		if r.Header.Get("X-Forwarded-For") != "" {
+			t.Error("unlisted headers should not be forwarded")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+
+	req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+	req.Header.Set("Accept-Language", "el-GR")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestHandler_PassesThroughAndCachesResponseHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Link", `<https://example.com/next>; rel="next"`)
+		w.Header().Set("Content-Disposition", `attachment; filename="report.csv"`)
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("Access-Control-Allow-Origin", "https://evil.example")
+		w.Write([]byte("a,b,c"))
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+
+	for _, want := range []string{"MISS", "HIT"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+		if rec.Header().Get("X-Cache") != want {
+			t.Fatalf("expected X-Cache: %s, got %s", want, rec.Header().Get("X-Cache"))
+		}
+		for _, name := range []string{"Cache-Control", "ETag", "Link", "Content-Disposition"} {
+			if rec.Header().Get(name) == "" {
+				t.Errorf("%s: expected %s to be passed through", want, name)
+			}
+		}
+		for _, name := range []string{"Set-Cookie", "X-Internal"} {
+			if rec.Header().Get(name) != "" {
+				t.Errorf("%s: expected %s to be stripped", want, name)
+			}
+		}
+		if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: upstream must not set CORS headers", want)
+		}
+	}
+}
+
+func TestHandler_CookiesWhenEnabledAreNeverCached(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024), WithHeaderPolicies(
+		proxy.NewHeaderPolicy(proxy.DefaultRequestHeaders, nil, true),
+		proxy.NewHeaderPolicy(proxy.DefaultResponseHeaders, nil, true),
+	))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+	if rec.Header().Get("Set-Cookie") != "session=abc" {
+		t.Errorf("expected Set-Cookie to pass when enabled, got %q", rec.Header().Get("Set-Cookie"))
+	}
+	entry, found, _ := mockC.Get(server.URL)
+	if !found {
+		t.Fatal("expected response to be cached")
+	}
+	if entry.Header.Get("Set-Cookie") != "" {
+		t.Error("Set-Cookie must not be stored in the cache")
+	}
+}
+
+func TestHandler_DoesNotCacheAuthorizedResponsesByDefault(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		wantCached   bool
+	}{
+		{"max-age=60", false},
+		{"public, max-age=60", true},
+		{"s-maxage=60", true},
 	}
 
-	cors := rec.Header().Get("Access-Control-Allow-Origin")
-	if cors != "*" {
-		t.Errorf("expected CORS header *, got %s", cors)
+	for _, tt := range tests {
+		t.Run(tt.cacheControl, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer token" {
+					t.Errorf("expected Authorization to be forwarded")
+				}
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.Write([]byte("private data"))
+			}))
+			defer server.Close()
+
+			mockC := newMockCache()
+			h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+			req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+			req.Header.Set("Authorization", "Bearer token")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if _, found, _ := mockC.Get(server.URL); found != tt.wantCached {
+				t.Errorf("cached = %v, want %v", found, tt.wantCached)
+			}
+		})
+	}
+}
+
+func TestHandler_PropagatesAndCachesStatusCodes(t *testing.T) {
+	tests := []struct {
+		status     int
+		wantCached bool
+	}{
+		{http.StatusOK, true},
+		{http.StatusNonAuthoritativeInfo, true},
+		{http.StatusNotFound, true},
+		{http.StatusGone, true},
+		{http.StatusAccepted, false},
+		{http.StatusTeapot, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte("body"))
+			}))
+			defer server.Close()
+
+			mockC := newMockCache()
+			h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+			if rec.Code != tt.status {
+				t.Errorf("expected status %d, got %d", tt.status, rec.Code)
+			}
+
+			_, found, _ := mockC.Get(server.URL)
+			if found != tt.wantCached {
+				t.Fatalf("cached = %v, want %v", found, tt.wantCached)
+			}
+			if !found {
+				return
+			}
+
+			// Cached responses replay the upstream status
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+			if rec.Code != tt.status || rec.Header().Get("X-Cache") != "HIT" {
+				t.Errorf("expected cached %d, got %d (%s)", tt.status, rec.Code, rec.Header().Get("X-Cache"))
+			}
+		})
+	}
+}
+
+func TestHandler_NegativeCacheTTL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024),
+		WithNegativeTTL(time.Minute, map[int]time.Duration{http.StatusGone: 0}))
+
+	start := time.Now()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?url="+server.URL+"/missing", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?url="+server.URL+"/gone", nil))
+
+	expires := mockC.expires[cache.GenerateCacheKey(server.URL+"/missing")]
+	if ttl := expires.Sub(start); ttl > time.Minute+time.Second || ttl < time.Minute-time.Second {
+		t.Errorf("expected 404 to be cached for the negative TTL, got %v", ttl)
+	}
+	if _, found, _ := mockC.Get(server.URL + "/gone"); found {
+		t.Error("expected a zero per-status TTL to disable caching")
+	}
+}
+
+func TestHandler_PassthroughPropagatesStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/?url="+server.URL, strings.NewReader("{}")))
+
+	if rec.Code != http.StatusCreated {
+		t.Errorf("expected 201, got %d", rec.Code)
+	}
+}
+
+func TestHandler_AnswersBareOptions(t *testing.T) {
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+
+	req := httptest.NewRequest("OPTIONS", "/?url=https://example.com", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected 204 for OPTIONS, got %d", rec.Code)
 	}
 }
 
@@ -185,7 +905,7 @@ func TestHandler_ProxiesContentType(t *testing.T) {
 	}))
 	defer server.Close()
 
-	h := NewProxyHandler(newMockCache(), proxy.NewFetcher(10*time.Second, 10*1024*1024))
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
 
 	req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
 	rec := httptest.NewRecorder()
@@ -199,7 +919,7 @@ func TestHandler_ProxiesContentType(t *testing.T) {
 
 func TestHandler_HandlesUpstreamErrors(t *testing.T) {
 	// Use an invalid server that will refuse connections
-	h := NewProxyHandler(newMockCache(), proxy.NewFetcher(1*time.Second, 10*1024*1024))
+	h := NewProxyHandler(newMockCache(), newTestFetcher(1*time.Second, 10*1024*1024))
 
 	req := httptest.NewRequest("GET", "/?url=http://localhost:59999/noexist", nil)
 	rec := httptest.NewRecorder()
@@ -210,6 +930,447 @@ func TestHandler_HandlesUpstreamErrors(t *testing.T) {
 	}
 }
 
+func TestHandler_BlocksPrivateDestinations(t *testing.T) {
+	h := NewProxyHandler(newMockCache(), proxy.NewFetcher(1*time.Second, 10*1024*1024))
+
+	for _, target := range []string{
+		"http://127.0.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]:8080/",
+		"http://localhost:59999/",
+	} {
+		req := httptest.NewRequest("GET", "/?url="+target, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403, got %d", target, rec.Code)
+		}
+	}
+}
+
+func TestHandler_AppliesHostRules(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	rules, err := proxy.NewHostRules([]proxy.HostRule{
+		{Host: "127.0.0.1", Action: proxy.ActionAllow, TTL: proxy.Duration(10 * time.Minute)},
+	}, false)
+	if err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	policy, _ := proxy.NewDestinationPolicy([]string{"127.0.0.0/8"}, nil)
+	fetcher := proxy.NewFetcher(5*time.Second, 1024, proxy.WithDestinationPolicy(policy), proxy.WithHostRules(rules))
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, fetcher)
+
+	// The rule TTL overrides upstream's no-cache
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	expires, cached := mockC.expires[cache.GenerateCacheKey(server.URL)]
+	if !cached {
+		t.Fatal("expected the response to be cached")
+	}
+	if ttl := expires.Sub(start); ttl < 10*time.Minute-time.Second || ttl > 10*time.Minute+time.Second {
+		t.Errorf("expected the rule TTL, got %v", ttl)
+	}
+
+	// Hosts without a rule follow the default deny policy
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url=https://example.com/", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an unlisted host, got %d", rec.Code)
+	}
+}
+
+func TestHandler_SeparatesInjectedCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	rules, _ := proxy.NewHostRules([]proxy.HostRule{{
+		Host:   "127.0.0.1",
+		Action: proxy.ActionAllow,
+		Inject: &proxy.Injection{Query: map[string]string{"api_key": "s3cret"}},
+	}}, false)
+	policy, _ := proxy.NewDestinationPolicy([]string{"127.0.0.0/8"}, nil)
+	fetcher := proxy.NewFetcher(5*time.Second, 1024, proxy.WithDestinationPolicy(policy), proxy.WithHostRules(rules))
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, fetcher)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL+"/data", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	// Cached under its own namespace, keyed by the URL without the secret
+	if _, cached := mockC.expires[cache.GenerateCacheKey("injected+"+server.URL+"/data")]; !cached {
+		t.Error("expected the response in the injected namespace")
+	}
+	if _, cached := mockC.expires[cache.GenerateCacheKey(server.URL+"/data")]; cached {
+		t.Error("injected response must not share the plain cache key")
+	}
+}
+
+func TestHandler_NormalizesCacheKeys(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(5*time.Second, 1024),
+		WithKeyNormalizer(cache.NewKeyNormalizer(cache.DefaultStripParams)))
+
+	targets := []string{
+		server.URL + "/data?b=2&a=1&utm_source=mail",
+		server.URL + "/data?a=1&b=2",
+		server.URL + "/%64ata?a=1&fbclid=abc&b=2",
+	}
+	for i, target := range targets {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+url.QueryEscape(target), nil))
+		want := "HIT"
+		if i == 0 {
+			want = "MISS"
+		}
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("%s: expected X-Cache %s, got %s", target, want, got)
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("expected 1 upstream request, got %d", n)
+	}
+}
+
+func TestHandler_KeysOnRuleHeaders(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("lang=" + r.Header.Get("Accept-Language")))
+	}))
+	defer server.Close()
+
+	rules, _ := proxy.NewHostRules([]proxy.HostRule{{
+		Host:       "127.0.0.1",
+		Action:     proxy.ActionAllow,
+		KeyHeaders: []string{"accept-language"},
+	}}, false)
+	policy, _ := proxy.NewDestinationPolicy([]string{"127.0.0.0/8"}, nil)
+	fetcher := proxy.NewFetcher(5*time.Second, 1024, proxy.WithDestinationPolicy(policy), proxy.WithHostRules(rules))
+	h := NewProxyHandler(newMockCache(), fetcher)
+
+	get := func(lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/?url="+server.URL+"/page", nil)
+		req.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, step := range []struct{ lang, cache string }{
+		{"en", "MISS"},
+		{"fr", "MISS"},
+		{"en", "HIT"},
+		{"fr", "HIT"},
+	} {
+		rec := get(step.lang)
+		if got := rec.Header().Get("X-Cache"); got != step.cache {
+			t.Errorf("%s: expected X-Cache %s, got %s", step.lang, step.cache, got)
+		}
+		if body := rec.Body.String(); body != "lang="+step.lang {
+			t.Errorf("%s: got body %q", step.lang, body)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", n)
+	}
+}
+
+func TestHandler_CachesVariants(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/star" {
+			w.Header().Set("Vary", "*")
+		} else {
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		w.Write([]byte("lang=" + r.Header.Get("Accept-Language")))
+	}))
+	defer server.Close()
+
+	c, err := cache.NewBadgerCache(t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer c.Close()
+	h := NewProxyHandler(c, newTestFetcher(5*time.Second, 1024))
+
+	get := func(path, lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/?url="+server.URL+path, nil)
+		req.Header.Set("Accept-Language", lang)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, step := range []struct{ lang, cache string }{
+		{"en", "MISS"},
+		{"fr", "MISS"},
+		{"en", "HIT"},
+		{"fr", "HIT"},
+	} {
+		rec := get("/page", step.lang)
+		if got := rec.Header().Get("X-Cache"); got != step.cache {
+			t.Errorf("%s: expected X-Cache %s, got %s", step.lang, step.cache, got)
+		}
+		if body := rec.Body.String(); body != "lang="+step.lang {
+			t.Errorf("%s: got body %q", step.lang, body)
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", n)
+	}
+
+	// "Vary: *" responses match no later request and are not stored
+	get("/star", "en")
+	if rec := get("/star", "en"); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("expected Vary: * to be refetched, got %s", rec.Header().Get("X-Cache"))
+	}
+}
+
+func TestHandler_BareNotModifiedKeepsStoredLifetime(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(10*time.Second, 10*1024*1024))
+
+	key := cache.GenerateCacheKey(server.URL)
+	mockC.entries[key] = &cache.CachedResponse{
+		Data:        []byte("cached data"),
+		ContentType: "text/plain",
+		Header:      http.Header{"Cache-Control": {"max-age=5"}},
+		ETag:        `"v1"`,
+		ExpiresAt:   time.Now().Add(-time.Minute),
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+	if rec.Header().Get("X-Cache") != "REVALIDATED" {
+		t.Fatalf("expected a revalidated response, got %q", rec.Header().Get("X-Cache"))
+	}
+	if ttl := time.Until(mockC.expires[key]); ttl <= 0 || ttl > 5*time.Second {
+		t.Errorf("expected the stored max-age of 5s, got %v", ttl)
+	}
+}
+
+func TestHandler_ServesStaleWhileRevalidating(t *testing.T) {
+	var requests atomic.Int32
+	refreshed := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=60")
+		w.Write([]byte("v" + strconv.Itoa(int(n))))
+		if n > 1 {
+			refreshed <- struct{}{}
+		}
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(5*time.Second, 1024))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+	// Expire the entry without waiting for it
+	entry, _, _ := mockC.Get(server.URL)
+	entry.ExpiresAt = time.Now().Add(-time.Second)
+	mockC.mu.Lock()
+	mockC.entries[cache.GenerateCacheKey(server.URL)] = entry
+	mockC.mu.Unlock()
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	if rec.Header().Get("X-Cache") != "STALE" || rec.Body.String() != "v1" {
+		t.Fatalf("expected the stale entry, got %s %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a background refresh")
+	}
+	// The refresh is stored once the upstream body has been read
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if entry, found, _ := mockC.Get(server.URL); found && string(entry.Data) == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the refreshed entry to be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandler_RefreshesStaleEntryForRangeRequest(t *testing.T) {
+	var requests, ranged atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=60")
+		if r.Header.Get("Range") != "" {
+			ranged.Add(1)
+			w.Header().Set("Content-Range", "bytes 0-0/2")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte("v"))
+			return
+		}
+		w.Write([]byte("v" + strconv.Itoa(int(n))))
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(5*time.Second, 1024))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?url="+server.URL, nil))
+
+	// Expire the entry without waiting for it
+	entry, _, _ := mockC.Get(server.URL)
+	entry.ExpiresAt = time.Now().Add(-time.Second)
+	mockC.mu.Lock()
+	mockC.entries[cache.GenerateCacheKey(server.URL)] = entry
+	mockC.mu.Unlock()
+
+	req := httptest.NewRequest("GET", "/?url="+server.URL, nil)
+	req.Header.Set("Range", "bytes=0-0")
+	req.Header.Set("If-Range", `"v1"`)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Header().Get("X-Cache") != "STALE" {
+		t.Fatalf("expected the stale entry, got %s", rec.Header().Get("X-Cache"))
+	}
+
+	// The refresh fetches and stores the whole body
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if entry, found, _ := mockC.Get(server.URL); found && string(entry.Data) == "v2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the refreshed entry to be cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ranged.Load() != 0 {
+		t.Errorf("expected the refresh not to forward the client's range, got %d ranged requests", ranged.Load())
+	}
+}
+
+func TestHandler_ServesStaleOnError(t *testing.T) {
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Write([]byte("data"))
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(5*time.Second, 1024), WithStaleWindows(0, time.Hour))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	entry, _, _ := mockC.Get(server.URL)
+	if entry.StaleIfError != time.Hour {
+		t.Fatalf("expected the configured stale-if-error window, got %v", entry.StaleIfError)
+	}
+	entry.ExpiresAt = time.Now().Add(-time.Second)
+	mockC.mu.Lock()
+	mockC.entries[cache.GenerateCacheKey(server.URL)] = entry
+	mockC.mu.Unlock()
+
+	// Upstream answers 5xx
+	failing.Store(true)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("expected the stale entry on 503, got %d %s", rec.Code, rec.Header().Get("X-Cache"))
+	}
+
+	// Upstream is unreachable
+	server.Close()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "STALE" {
+		t.Errorf("expected the stale entry when unreachable, got %d %s", rec.Code, rec.Header().Get("X-Cache"))
+	}
+
+	// Past the window the error is reported
+	entry.ExpiresAt = time.Now().Add(-2 * time.Hour)
+	mockC.mu.Lock()
+	mockC.entries[cache.GenerateCacheKey(server.URL)] = entry
+	mockC.mu.Unlock()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/?url="+server.URL, nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("expected 502 past the window, got %d", rec.Code)
+	}
+}
+
+func TestHandler_RestrictsAPIKeyDestinations(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(5*time.Second, 10*1024*1024))
+
+	tests := []struct {
+		key  *auth.Key
+		want int
+	}{
+		{nil, http.StatusOK},
+		{&auth.Key{Key: "open"}, http.StatusOK},
+		{&auth.Key{Key: "local", AllowedHosts: []string{"127.0.0.1"}}, http.StatusOK},
+		{&auth.Key{Key: "partner", AllowedHosts: []string{"api.partner.org"}}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/?url="+upstream.URL, nil)
+		if tt.key != nil {
+			req = req.WithContext(auth.NewContext(req.Context(), tt.key))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tt.want {
+			t.Errorf("key %+v: expected %d, got %d", tt.key, tt.want, rec.Code)
+		}
+	}
+}
+
 // Helper to read response
 func readBody(t *testing.T, resp *http.Response) string {
 	body, err := io.ReadAll(resp.Body)
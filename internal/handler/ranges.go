@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/harold/proxy-harold/internal/cache"
+)
+
+// errUnsatisfiableRange is returned when no requested range overlaps the body
+var errUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+// byteRange is a part of a body, starting at start
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header against a body of size bytes. It
+// returns no ranges for headers it does not understand, which are then
+// ignored, and errUnsatisfiableRange if none of the ranges overlap.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	specs, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	satisfiable := false
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+
+		var r byteRange
+		if first == "" {
+			// A suffix range selects the last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		if r.length > 0 {
+			satisfiable = true
+			ranges = append(ranges, r)
+		}
+	}
+	if !satisfiable {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether an If-Range validator still matches the
+// entry, so the requested ranges may be served. Only strong ETags and an
+// exact Last-Modified date match.
+func ifRangeMatches(ifRange string, entry *cache.CachedResponse) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return entry.ETag == ifRange
+	}
+	if entry.LastModified == "" {
+		return false
+	}
+	want, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(entry.LastModified)
+	return err == nil && lastModified.Equal(want)
+}
+
+// writeRanges answers a Range request from a cached body. It reports false
+// when the request should get the full body instead.
+func (h *ProxyHandler) writeRanges(w http.ResponseWriter, r *http.Request, entry *cache.CachedResponse) bool {
+	header := r.Header.Get("Range")
+	if header == "" || r.Method != http.MethodGet || entry.Status() != http.StatusOK {
+		return false
+	}
+	if !ifRangeMatches(r.Header.Get("If-Range"), entry) {
+		return false
+	}
+
+	size := int64(len(entry.Data))
+	ranges, err := parseRange(header, size)
+	if errors.Is(err, errUnsatisfiableRange) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		h.sendError(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	// Overlapping ranges adding up to more than the body are not worth
+	// splitting up
+	var total int64
+	for _, r := range ranges {
+		total += r.length
+	}
+	if len(ranges) == 0 || total > size {
+		return false
+	}
+
+	if len(ranges) == 1 {
+		part := ranges[0]
+		w.Header().Set("Content-Range", part.contentRange(size))
+		w.Header().Set("Content-Length", strconv.FormatInt(part.length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(entry.Data[part.start : part.start+part.length])
+		return true
+	}
+
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	for _, part := range ranges {
+		pw, _ := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {entry.ContentType},
+			"Content-Range": {part.contentRange(size)},
+		})
+		pw.Write(entry.Data[part.start : part.start+part.length])
+	}
+	parts.Close()
+
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+parts.Boundary())
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write(body.Bytes())
+	return true
+}
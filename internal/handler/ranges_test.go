@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/cache"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=0-4", []byteRange{{0, 5}}, nil},
+		{"bytes=5-", []byteRange{{5, 5}}, nil},
+		{"bytes=-3", []byteRange{{7, 3}}, nil},
+		{"bytes=-20", []byteRange{{0, 10}}, nil},
+		{"bytes=8-20", []byteRange{{8, 2}}, nil},
+		{"bytes=0-1, 4-5", []byteRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=20-30, 2-3", []byteRange{{2, 2}}, nil},
+		{"bytes=10-", nil, errUnsatisfiableRange},
+		{"bytes=-0", nil, errUnsatisfiableRange},
+		{"bytes=3-1", nil, nil},
+		{"bytes=a-b", nil, nil},
+		{"items=0-1", nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := parseRange(tt.header, 10)
+			if !errors.Is(err, tt.err) || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v %v, want %v %v", got, err, tt.want, tt.err)
+			}
+		})
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	entry := &cache.CachedResponse{ETag: `"v1"`, LastModified: "Tue, 14 Nov 2023 22:13:20 GMT"}
+
+	for ifRange, want := range map[string]bool{
+		"":                              true,
+		`"v1"`:                          true,
+		`"v2"`:                          false,
+		`W/"v1"`:                        false,
+		"Tue, 14 Nov 2023 22:13:20 GMT": true,
+		"Tue, 14 Nov 2023 22:13:21 GMT": false,
+		"yesterday":                     false,
+	} {
+		if got := ifRangeMatches(ifRange, entry); got != want {
+			t.Errorf("If-Range %q: got %v, want %v", ifRange, got, want)
+		}
+	}
+}
+
+func TestHandler_ServesRangesFromCache(t *testing.T) {
+	mockC := newMockCache()
+	mockC.Set("https://example.com/audio", &cache.CachedResponse{
+		Data:        []byte("0123456789"),
+		ContentType: "audio/mpeg",
+		ETag:        `"v1"`,
+		ExpiresAt:   time.Now().Add(time.Hour),
+	})
+	h := NewProxyHandler(mockC, newTestFetcher(5*time.Second, 1024))
+
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/?url=https://example.com/audio", nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(nil)
+	if rec.Code != http.StatusOK || rec.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("expected 200 advertising ranges, got %d %q", rec.Code, rec.Header().Get("Accept-Ranges"))
+	}
+
+	rec = get(http.Header{"Range": {"bytes=2-4"}})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "234" {
+		t.Errorf("expected 206 with 234, got %d %q", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 2-4/10" {
+		t.Errorf("unexpected Content-Range %q", got)
+	}
+	if rec.Header().Get("Content-Length") != "3" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("unexpected headers %v", rec.Header())
+	}
+
+	// A changed entry ignores the range
+	rec = get(http.Header{"Range": {"bytes=2-4"}, "If-Range": {`"v0"`}})
+	if rec.Code != http.StatusOK || rec.Body.String() != "0123456789" {
+		t.Errorf("expected the full body, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = get(http.Header{"Range": {"bytes=20-"}})
+	if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */10" {
+		t.Errorf("expected 416, got %d %q", rec.Code, rec.Header().Get("Content-Range"))
+	}
+
+	rec = get(http.Header{"Range": {"bytes=0-1,-2"}, "If-Range": {`"v1"`}})
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", rec.Code)
+	}
+	mediaType, params, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		t.Fatalf("unexpected content type %q", mediaType)
+	}
+	reader := multipart.NewReader(rec.Body, params["boundary"])
+	var parts []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("bad multipart body: %v", err)
+		}
+		data, _ := io.ReadAll(part)
+		parts = append(parts, part.Header.Get("Content-Range")+" "+part.Header.Get("Content-Type")+" "+string(data))
+	}
+	want := []string{"bytes 0-1/10 audio/mpeg 01", "bytes 8-9/10 audio/mpeg 89"}
+	if !reflect.DeepEqual(parts, want) {
+		t.Errorf("got parts %q, want %q", parts, want)
+	}
+}
+
+func TestHandler_ForwardsRangeMisses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer server.Close()
+
+	mockC := newMockCache()
+	h := NewProxyHandler(mockC, newTestFetcher(5*time.Second, 1024))
+
+	req := httptest.NewRequest("GET", "/?url="+server.URL+"/audio", nil)
+	req.Header.Set("Range", "bytes=5-")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "56789" {
+		t.Errorf("expected upstream 206, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Content-Range") != "bytes 5-9/10" || rec.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("expected range headers to pass through, got %v", rec.Header())
+	}
+	if len(mockC.entries) != 0 {
+		t.Error("partial content must not be cached")
+	}
+
+	// Once the full body is cached, ranges are cut from it
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?url="+server.URL+"/audio", nil))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "56789" || rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expected a cached 206, got %d %q %s", rec.Code, rec.Body.String(), rec.Header().Get("X-Cache"))
+	}
+}
@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/harold/proxy-harold/internal/cache"
+)
+
+// CacheStats is the cache interface needed by the stats endpoint
+type CacheStats interface {
+	Stats() cache.Stats
+	QuotaStats() cache.QuotaStats
+}
+
+// StatsResponse reports the state of the cache
+type StatsResponse struct {
+	Disk  cache.Stats      `json:"disk"`
+	Quota cache.QuotaStats `json:"quota"`
+	// Tiers is only reported for a tiered cache
+	Tiers *cache.TierStats `json:"tiers,omitempty"`
+}
+
+// StatsHandler serves /admin/cache/stats. Every request must carry
+// "Authorization: Bearer <token>".
+type StatsHandler struct {
+	cache CacheStats
+	token string
+}
+
+// NewStatsHandler creates a stats handler. An empty token rejects every
+// request.
+func NewStatsHandler(c CacheStats, token string) *StatsHandler {
+	return &StatsHandler{
+		cache: c,
+		token: token,
+	}
+}
+
+// ServeHTTP handles GET /admin/cache/stats
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r, h.token) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := StatsResponse{
+		Disk:  h.cache.Stats(),
+		Quota: h.cache.QuotaStats(),
+	}
+	if tiered, ok := h.cache.(interface{ TierStats() cache.TierStats }); ok {
+		tiers := tiered.TierStats()
+		resp.Tiers = &tiers
+	}
+	sendJSON(w, resp, http.StatusOK)
+}
+
+// Ensure both cache implementations satisfy the CacheStats interface
+var (
+	_ CacheStats = (*cache.BadgerCache)(nil)
+	_ CacheStats = (*cache.TieredCache)(nil)
+)
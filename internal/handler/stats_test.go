@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/cache"
+)
+
+func TestStats_ReportsQuotaAndTiers(t *testing.T) {
+	disk, err := cache.NewBadgerCache(t.TempDir(), time.Hour, cache.WithMaxSize(1<<20, cache.EvictLRU))
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	c := cache.NewTieredCache(disk, 1<<20)
+	t.Cleanup(func() { c.Close() })
+
+	c.Set("https://example.com/", &cache.CachedResponse{Data: []byte("data")})
+	c.Get("https://example.com/")
+
+	h := NewStatsHandler(c, "secret")
+	if rec := adminRequest(h, "GET", nil, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rec.Code)
+	}
+
+	rec := adminRequest(h, "GET", url.Values{}, "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var stats StatsResponse
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("failed to decode stats: %v", err)
+	}
+	if stats.Quota.MaxBytes != 1<<20 || stats.Quota.UsedBytes == nil || *stats.Quota.UsedBytes == 0 || stats.Quota.Policy != cache.EvictLRU {
+		t.Errorf("unexpected quota %+v", stats.Quota)
+	}
+	if stats.Tiers == nil || stats.Tiers.MemoryHits != 1 {
+		t.Errorf("unexpected tiers %+v", stats.Tiers)
+	}
+
+	if rec := adminRequest(h, "DELETE", url.Values{}, "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,85 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrMissingTarget   = errors.New("missing required 'url' parameter")
+	ErrAmbiguousTarget = errors.New("ambiguous target: use either a path-style URL or the 'url' parameter, not both")
+	ErrMalformedTarget = errors.New("malformed target in /raw/ path: expected base64url-encoded URL")
+)
+
+// rawPrefix introduces a base64url-encoded target URL
+const rawPrefix = "/raw/"
+
+// IsProxyPath reports whether a request path carries the target URL itself,
+// either as /https://host/path or as /raw/<base64url>
+func IsProxyPath(path string) bool {
+	return strings.HasPrefix(path, rawPrefix) || schemeLength(strings.TrimPrefix(path, "/")) > 0
+}
+
+// parseTarget extracts the upstream URL from a request. It accepts
+// /?url=<URL>, /<URL> and /raw/<base64url(URL)>, and yields the same string
+// for the same target regardless of the form used.
+func parseTarget(r *http.Request) (string, error) {
+	path := r.URL.EscapedPath()
+
+	// /raw/<base64url>: the query string belongs to the proxy
+	if strings.HasPrefix(path, rawPrefix) {
+		if r.URL.Query().Has("url") {
+			return "", ErrAmbiguousTarget
+		}
+
+		encoded := strings.TrimRight(strings.TrimPrefix(path, rawPrefix), "=")
+		if encoded == "" {
+			return "", ErrMalformedTarget
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return "", ErrMalformedTarget
+		}
+		return string(decoded), nil
+	}
+
+	// /https://host/path?query: the query string belongs to the target
+	if rest := strings.TrimPrefix(path, "/"); schemeLength(rest) > 0 {
+		target := restoreSchemeSlashes(rest)
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		return target, nil
+	}
+
+	target := r.URL.Query().Get("url")
+	if target == "" {
+		return "", ErrMissingTarget
+	}
+	return target, nil
+}
+
+// schemeLength returns the length of a leading "http:" or "https:" scheme
+func schemeLength(s string) int {
+	lower := strings.ToLower(s[:min(len(s), len("https:"))])
+	switch {
+	case strings.HasPrefix(lower, "https:"):
+		return len("https:")
+	case strings.HasPrefix(lower, "http:"):
+		return len("http:")
+	}
+	return 0
+}
+
+// restoreSchemeSlashes turns "https:/host" back into "https://host", as
+// intermediaries commonly merge the double slash in paths
+func restoreSchemeSlashes(s string) string {
+	n := schemeLength(s)
+	scheme, rest := s[:n], s[n:]
+	if !strings.HasPrefix(rest, "//") {
+		rest = "//" + strings.TrimPrefix(rest, "/")
+	}
+	return scheme + rest
+}
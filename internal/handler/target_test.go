@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseTarget_EquivalentForms(t *testing.T) {
+	const target = "https://api.example.com/v1/items?x=1&filter=a%26b"
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(target))
+	padded := base64.URLEncoding.EncodeToString([]byte(target))
+
+	for _, requestURI := range []string{
+		"/?url=" + url.QueryEscape(target),
+		"/https://api.example.com/v1/items?x=1&filter=a%26b",
+		"/https:/api.example.com/v1/items?x=1&filter=a%26b",
+		"/raw/" + encoded,
+		"/raw/" + padded,
+	} {
+		t.Run(requestURI, func(t *testing.T) {
+			got, err := parseTarget(httptest.NewRequest("GET", requestURI, nil))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != target {
+				t.Errorf("got %q, want %q", got, target)
+			}
+		})
+	}
+}
+
+func TestParseTarget_Errors(t *testing.T) {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("https://example.com"))
+
+	tests := []struct {
+		requestURI string
+		want       error
+	}{
+		{"/", ErrMissingTarget},
+		{"/?url=", ErrMissingTarget},
+		{"/raw/", ErrMalformedTarget},
+		{"/raw/not*base64!", ErrMalformedTarget},
+		{"/raw/" + encoded + "?url=https://other.example.com", ErrAmbiguousTarget},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.requestURI, func(t *testing.T) {
+			_, err := parseTarget(httptest.NewRequest("GET", tt.requestURI, nil))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsProxyPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/https://example.com/", true},
+		{"/http:/example.com", true},
+		{"/raw/aHR0cHM6Ly9leGFtcGxlLmNvbQ", true},
+		{"/", false},
+		{"/health", false},
+		{"/httpbin", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsProxyPath(tt.path); got != tt.want {
+			t.Errorf("IsProxyPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestHandler_PathStyleSharesCacheEntry(t *testing.T) {
+	var hits int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer server.Close()
+
+	h := NewProxyHandler(newMockCache(), newTestFetcher(10*time.Second, 10*1024*1024))
+	target := server.URL + "/data?a=1&b=2"
+
+	for i, requestURI := range []string{
+		"/?url=" + url.QueryEscape(target),
+		"/" + target,
+		"/raw/" + base64.RawURLEncoding.EncodeToString([]byte(target)),
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", requestURI, nil))
+
+		if rec.Body.String() != "a=1&b=2" {
+			t.Errorf("%s: unexpected body %q", requestURI, rec.Body.String())
+		}
+		want := "HIT"
+		if i == 0 {
+			want = "MISS"
+		}
+		if rec.Header().Get("X-Cache") != want {
+			t.Errorf("%s: expected X-Cache %s, got %s", requestURI, want, rec.Header().Get("X-Cache"))
+		}
+	}
+
+	if hits != 1 {
+		t.Errorf("expected 1 upstream request, got %d", hits)
+	}
+}
@@ -0,0 +1,19 @@
+package httperror
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Response is the JSON body of the proxy's error responses
+type Response struct {
+	Error string `json:"error"`
+	Code  int    `json:"code"`
+}
+
+// Write sends a JSON error response in the proxy's error format
+func Write(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(Response{Error: message, Code: code})
+}
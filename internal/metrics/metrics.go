@@ -0,0 +1,262 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics collects Prometheus metrics for the proxy
+type Metrics struct {
+	registry        *prometheus.Registry
+	requests        *prometheus.CounterVec
+	aborted         *prometheus.CounterVec
+	responseBytes   *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+
+	// hosts are the destinations labelled by name, up to maxHosts
+	hostsMu  sync.Mutex
+	hosts    map[string]bool
+	maxHosts int
+}
+
+// Option configures Metrics
+type Option func(*Metrics)
+
+// WithUpstreamHosts labels upstream latency by destination host for the
+// first n hosts seen. Later hosts are labelled by their host rule, so the
+// number of series stays bounded on an open proxy.
+func WithUpstreamHosts(n int) Option {
+	return func(m *Metrics) {
+		m.maxHosts = n
+	}
+}
+
+// New creates a metrics registry with the request and upstream metrics
+func New(opts ...Option) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_total",
+			Help: "Proxy requests by response status and cache result.",
+		}, []string{"status", "cache"}),
+		aborted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_requests_aborted_total",
+			Help: "Proxy requests whose response was cut off, by cache result.",
+		}, []string{"cache"}),
+		responseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxy_response_bytes_total",
+			Help: "Response body bytes sent to clients, by source.",
+		}, []string{"source"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxy_upstream_request_duration_seconds",
+			Help:    "Time until upstream response headers, by destination host or host rule.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"host"}),
+		hosts: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	m.registry.MustRegister(m.requests, m.aborted, m.responseBytes, m.upstreamLatency)
+	return m
+}
+
+// ObserveUpstream records the latency of one upstream request to host,
+// labelled by rule, the matching host rule pattern, unless host is one of
+// the hosts labelled by name
+func (m *Metrics) ObserveUpstream(host, rule string, duration time.Duration) {
+	m.upstreamLatency.WithLabelValues(m.hostLabel(host, rule)).Observe(duration.Seconds())
+}
+
+// hostLabel returns host if it is, or can become, one of the named hosts
+func (m *Metrics) hostLabel(host, rule string) string {
+	if m.maxHosts <= 0 {
+		return rule
+	}
+
+	m.hostsMu.Lock()
+	defer m.hostsMu.Unlock()
+	if !m.hosts[host] {
+		if len(m.hosts) >= m.maxHosts {
+			return rule
+		}
+		m.hosts[host] = true
+	}
+	return host
+}
+
+// CounterFunc exposes a monotonically increasing value read on each scrape
+func (m *Metrics) CounterFunc(name, help string, fn func() int64) {
+	m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: name,
+		Help: help,
+	}, func() float64 { return float64(fn()) }))
+}
+
+// GaugeFunc exposes a value read on each scrape
+func (m *Metrics) GaugeFunc(name, help string, fn func() int64) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: name,
+		Help: help,
+	}, func() float64 { return float64(fn()) }))
+}
+
+// WatchCache exposes BadgerDB size and LSM statistics
+func (m *Metrics) WatchCache(stats func() cache.Stats) {
+	m.registry.MustRegister(&cacheCollector{stats: stats})
+}
+
+// WatchTiers exposes lookups and hit ratios of the memory and disk cache tiers
+func (m *Metrics) WatchTiers(stats func() cache.TierStats) {
+	m.registry.MustRegister(&tierCollector{stats: stats})
+}
+
+// Handler serves the metrics in the Prometheus text exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware counts requests by status and X-Cache result, and response
+// bytes by whether they came from the cache or from upstream. Responses
+// without X-Cache, such as errors and 429s, are counted with cache="NONE".
+// Responses cut off with a panic are counted too, and as aborted.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+
+		defer func() {
+			cacheResult := w.Header().Get("X-Cache")
+			if cacheResult == "" {
+				cacheResult = "NONE"
+			}
+			m.requests.WithLabelValues(strconv.Itoa(wrapped.statusCode), cacheResult).Inc()
+			if wrapped.bytes > 0 && cacheResult != "NONE" {
+				m.responseBytes.WithLabelValues(bytesSource(cacheResult)).Add(float64(wrapped.bytes))
+			}
+			if p := recover(); p != nil {
+				m.aborted.WithLabelValues(cacheResult).Inc()
+				panic(p)
+			}
+		}()
+
+		next.ServeHTTP(wrapped, r)
+	})
+}
+
+// bytesSource maps an X-Cache result to where the body came from.
+// Coalesced responses share one upstream fetch, which the request that
+// made it already counted.
+func bytesSource(cacheResult string) string {
+	switch cacheResult {
+	case "HIT", "STALE", "REVALIDATED", "COALESCED":
+		return "cache"
+	default:
+		return "upstream"
+	}
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	bytes      int64
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	rw.statusCode = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err
+}
+
+// cacheCollector reads cache statistics on every scrape
+type cacheCollector struct {
+	stats func() cache.Stats
+}
+
+var (
+	lsmSizeDesc = prometheus.NewDesc("proxy_cache_lsm_size_bytes",
+		"Size of the BadgerDB LSM tree.", nil, nil)
+	vlogSizeDesc = prometheus.NewDesc("proxy_cache_vlog_size_bytes",
+		"Size of the BadgerDB value log.", nil, nil)
+	levelTablesDesc = prometheus.NewDesc("proxy_cache_lsm_level_tables",
+		"Number of tables per LSM level.", []string{"level"}, nil)
+	levelSizeDesc = prometheus.NewDesc("proxy_cache_lsm_level_size_bytes",
+		"Size of each LSM level.", []string{"level"}, nil)
+)
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- lsmSizeDesc
+	ch <- vlogSizeDesc
+	ch <- levelTablesDesc
+	ch <- levelSizeDesc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+	ch <- prometheus.MustNewConstMetric(lsmSizeDesc, prometheus.GaugeValue, float64(stats.LSMSize))
+	ch <- prometheus.MustNewConstMetric(vlogSizeDesc, prometheus.GaugeValue, float64(stats.VLogSize))
+	for _, level := range stats.Levels {
+		label := strconv.Itoa(level.Level)
+		ch <- prometheus.MustNewConstMetric(levelTablesDesc, prometheus.GaugeValue, float64(level.NumTables), label)
+		ch <- prometheus.MustNewConstMetric(levelSizeDesc, prometheus.GaugeValue, float64(level.Size), label)
+	}
+}
+
+// tierCollector reads cache tier statistics on every scrape
+type tierCollector struct {
+	stats func() cache.TierStats
+}
+
+var (
+	tierLookupsDesc = prometheus.NewDesc("proxy_cache_tier_lookups_total",
+		"Cache lookups reaching each tier, by result.", []string{"tier", "result"}, nil)
+	tierHitRatioDesc = prometheus.NewDesc("proxy_cache_tier_hit_ratio",
+		"Share of lookups reaching each tier that it answered.", []string{"tier"}, nil)
+	memoryEntriesDesc = prometheus.NewDesc("proxy_cache_memory_entries",
+		"Entries held in the memory tier.", nil, nil)
+	memoryBytesDesc = prometheus.NewDesc("proxy_cache_memory_bytes",
+		"Approximate size of the memory tier.", nil, nil)
+)
+
+func (c *tierCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tierLookupsDesc
+	ch <- tierHitRatioDesc
+	ch <- memoryEntriesDesc
+	ch <- memoryBytesDesc
+}
+
+func (c *tierCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.stats()
+
+	// Lookups missing memory fall through to disk
+	diskLookups := stats.DiskHits + stats.Misses
+	tiers := []struct {
+		name         string
+		hits, misses int64
+	}{
+		{"memory", stats.MemoryHits, diskLookups},
+		{"disk", stats.DiskHits, stats.Misses},
+	}
+	for _, tier := range tiers {
+		ch <- prometheus.MustNewConstMetric(tierLookupsDesc, prometheus.CounterValue, float64(tier.hits), tier.name, "hit")
+		ch <- prometheus.MustNewConstMetric(tierLookupsDesc, prometheus.CounterValue, float64(tier.misses), tier.name, "miss")
+		ratio := 0.0
+		if total := tier.hits + tier.misses; total > 0 {
+			ratio = float64(tier.hits) / float64(total)
+		}
+		ch <- prometheus.MustNewConstMetric(tierHitRatioDesc, prometheus.GaugeValue, ratio, tier.name)
+	}
+	ch <- prometheus.MustNewConstMetric(memoryEntriesDesc, prometheus.GaugeValue, float64(stats.MemoryEntries))
+	ch <- prometheus.MustNewConstMetric(memoryBytesDesc, prometheus.GaugeValue, float64(stats.MemoryBytes))
+}
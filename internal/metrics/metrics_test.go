@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/cache"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	return string(body)
+}
+
+func assertContains(t *testing.T, body string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(body, line) {
+			t.Errorf("expected metrics to contain %q", line)
+		}
+	}
+}
+
+func TestMiddleware_CountsRequestsAndBytes(t *testing.T) {
+	m := New()
+
+	h := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("case") {
+		case "hit":
+			w.Header().Set("X-Cache", "HIT")
+			w.Write([]byte("cached"))
+		case "miss":
+			w.Header().Set("X-Cache", "MISS")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("missing"))
+		case "coalesced":
+			w.Header().Set("X-Cache", "COALESCED")
+			w.Write([]byte("shared"))
+		case "aborted":
+			w.Header().Set("X-Cache", "MISS")
+			w.Write([]byte("cut"))
+			panic(http.ErrAbortHandler)
+		default:
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte("slow down"))
+		}
+	}))
+
+	for _, c := range []string{"hit", "hit", "miss", "limited", "coalesced", "aborted"} {
+		func() {
+			defer func() {
+				if p := recover(); p != nil && p != http.ErrAbortHandler {
+					t.Errorf("unexpected panic %v", p)
+				}
+			}()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/?case="+c, nil))
+		}()
+	}
+
+	assertContains(t, scrape(t, m),
+		`proxy_requests_total{cache="HIT",status="200"} 2`,
+		`proxy_requests_total{cache="MISS",status="404"} 1`,
+		`proxy_requests_total{cache="NONE",status="429"} 1`,
+		`proxy_requests_total{cache="COALESCED",status="200"} 1`,
+		`proxy_requests_total{cache="MISS",status="200"} 1`,
+		`proxy_requests_aborted_total{cache="MISS"} 1`,
+		`proxy_response_bytes_total{source="cache"} 18`,
+		`proxy_response_bytes_total{source="upstream"} 10`,
+	)
+}
+
+func TestObserveUpstream(t *testing.T) {
+	m := New()
+	m.ObserveUpstream("api.example.com", "*.example.com", 30*time.Millisecond)
+	m.ObserveUpstream("cdn.example.com", "*.example.com", 2*time.Second)
+
+	assertContains(t, scrape(t, m),
+		`proxy_upstream_request_duration_seconds_bucket{host="*.example.com",le="0.05"} 1`,
+		`proxy_upstream_request_duration_seconds_bucket{host="*.example.com",le="+Inf"} 2`,
+		`proxy_upstream_request_duration_seconds_count{host="*.example.com"} 2`,
+	)
+}
+
+func TestObserveUpstream_NamesFirstHosts(t *testing.T) {
+	m := New(WithUpstreamHosts(2))
+	for _, host := range []string{"a.example", "b.example", "c.example", "a.example"} {
+		m.ObserveUpstream(host, "other", time.Millisecond)
+	}
+
+	body := scrape(t, m)
+	assertContains(t, body,
+		`proxy_upstream_request_duration_seconds_count{host="a.example"} 2`,
+		`proxy_upstream_request_duration_seconds_count{host="b.example"} 1`,
+		`proxy_upstream_request_duration_seconds_count{host="other"} 1`,
+	)
+	if strings.Contains(body, "c.example") {
+		t.Error("expected hosts past the limit to be labelled by rule")
+	}
+}
+
+func TestWatchCache(t *testing.T) {
+	m := New()
+	m.WatchCache(func() cache.Stats {
+		return cache.Stats{
+			LSMSize:  1024,
+			VLogSize: 2048,
+			Levels:   []cache.LevelStats{{Level: 0, NumTables: 3, Size: 512}},
+		}
+	})
+
+	assertContains(t, scrape(t, m),
+		`proxy_cache_lsm_size_bytes 1024`,
+		`proxy_cache_vlog_size_bytes 2048`,
+		`proxy_cache_lsm_level_tables{level="0"} 3`,
+		`proxy_cache_lsm_level_size_bytes{level="0"} 512`,
+	)
+}
+
+func TestWatchTiers(t *testing.T) {
+	m := New()
+	m.WatchTiers(func() cache.TierStats {
+		return cache.TierStats{MemoryHits: 6, DiskHits: 3, Misses: 1, MemoryEntries: 2, MemoryBytes: 4096}
+	})
+
+	assertContains(t, scrape(t, m),
+		`proxy_cache_tier_lookups_total{result="hit",tier="memory"} 6`,
+		`proxy_cache_tier_lookups_total{result="miss",tier="memory"} 4`,
+		`proxy_cache_tier_lookups_total{result="hit",tier="disk"} 3`,
+		`proxy_cache_tier_hit_ratio{tier="memory"} 0.6`,
+		`proxy_cache_tier_hit_ratio{tier="disk"} 0.75`,
+		`proxy_cache_memory_entries 2`,
+		`proxy_cache_memory_bytes 4096`,
+	)
+}
+
+func TestFuncMetrics(t *testing.T) {
+	m := New()
+	tracked, rejected := int64(4), int64(9)
+	m.GaugeFunc("proxy_ratelimit_tracked_ips", "Tracked IPs.", func() int64 { return tracked })
+	m.CounterFunc("proxy_ratelimit_rejected_total", "Rejected requests.", func() int64 { return rejected })
+
+	assertContains(t, scrape(t, m),
+		"proxy_ratelimit_tracked_ips 4",
+		"proxy_ratelimit_rejected_total 9",
+	)
+
+	tracked, rejected = 1, 10
+	assertContains(t, scrape(t, m),
+		"proxy_ratelimit_tracked_ips 1",
+		"proxy_ratelimit_rejected_total 10",
+	)
+}
@@ -1,40 +1,135 @@
 package proxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
 )
 
 var (
-	ErrInvalidURL     = errors.New("invalid URL")
-	ErrInvalidScheme  = errors.New("URL scheme must be http or https")
-	ErrResponseTooBig = errors.New("response exceeds maximum allowed size")
+	ErrInvalidURL         = errors.New("invalid URL")
+	ErrInvalidScheme      = errors.New("URL scheme must be http or https")
+	ErrResponseTooBig     = errors.New("response exceeds maximum allowed size")
+	ErrBlockedDestination = errors.New("destination address is not allowed")
 )
 
 // Fetcher handles HTTP requests to remote URLs
 type Fetcher struct {
-	client  *http.Client
-	maxSize int64
+	client   *http.Client
+	timeout  time.Duration
+	maxSize  int64
+	policy   *DestinationPolicy
+	rules    *HostRules
+	observer LatencyObserver
+	// keepEncoding passes upstream content codings on instead of
+	// decompressing gzip transparently
+	keepEncoding bool
+}
+
+// LatencyObserver receives the time each upstream request took to return
+// response headers, with the destination host and the host pattern of the
+// matching host rule, or UnmatchedHost. Unlike hosts, rule patterns are a
+// bounded set.
+type LatencyObserver func(host, rule string, duration time.Duration)
+
+// UnmatchedHost is the rule pattern reported for destinations no host rule
+// matches
+const UnmatchedHost = "other"
+
+// Option configures a Fetcher
+type Option func(*Fetcher)
+
+// WithDestinationPolicy replaces the default destination policy
+func WithDestinationPolicy(p *DestinationPolicy) Option {
+	return func(f *Fetcher) {
+		f.policy = p
+	}
+}
+
+// WithHostRules restricts destinations and applies per-host limits and
+// headers
+func WithHostRules(rules *HostRules) Option {
+	return func(f *Fetcher) {
+		f.rules = rules
+	}
+}
+
+// WithLatencyObserver reports upstream latency for every request
+func WithLatencyObserver(observer LatencyObserver) Option {
+	return func(f *Fetcher) {
+		f.observer = observer
+	}
+}
+
+// AcceptEncoding is sent upstream when upstream encodings are kept
+const AcceptEncoding = "br, zstd, gzip"
+
+// WithUpstreamEncoding asks upstream for compressed responses and returns
+// them with their Content-Encoding, instead of letting the transport
+// decompress gzip. The size limit then counts the encoded bytes.
+func WithUpstreamEncoding(enabled bool) Option {
+	return func(f *Fetcher) {
+		f.keepEncoding = enabled
+	}
 }
 
 // NewFetcher creates a new URL fetcher with specified timeout and max response size
-func NewFetcher(timeout time.Duration, maxSize int64) *Fetcher {
-	return &Fetcher{
-		client: &http.Client{
-			Timeout: timeout,
-			// Don't follow redirects automatically - let the proxy handle them
-			CheckRedirect: func(req *http.Request, via []*http.Request) error {
-				if len(via) >= 10 {
-					return errors.New("too many redirects")
+func NewFetcher(timeout time.Duration, maxSize int64, opts ...Option) *Fetcher {
+	f := &Fetcher{
+		timeout: timeout,
+		maxSize: maxSize,
+		policy:  &DestinationPolicy{},
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   f.policy.control,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Never route through an environment proxy: the guard must see the
+	// real destination address.
+	transport.Proxy = nil
+
+	// The overall timeout is set per request, as host rules may change it
+	f.client = &http.Client{
+		Transport: transport,
+		// Don't follow redirects automatically - let the proxy handle them
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			if err := f.validateURL(req.URL); err != nil {
+				return err
+			}
+
+			// Rule headers and credentials only go to the hosts they were
+			// configured for. Every hop starts from the headers of the
+			// original request, so those of all earlier hosts are removed.
+			rule := f.Rule(req.URL.String())
+			for _, hop := range via {
+				if previous := f.Rule(hop.URL.String()); previous != nil && previous != rule {
+					previous.remove(req)
 				}
-				return nil
-			},
+			}
+			if rule != nil {
+				rule.apply(req)
+			}
+			return nil
 		},
-		maxSize: maxSize,
 	}
+
+	return f
 }
 
 // ValidateURL checks if the URL is valid and uses an allowed scheme
@@ -48,6 +143,11 @@ func (f *Fetcher) ValidateURL(rawURL string) error {
 		return fmt.Errorf("%w: %v", ErrInvalidURL, err)
 	}
 
+	return f.validateURL(parsed)
+}
+
+// validateURL checks scheme, host and literal IP destinations
+func (f *Fetcher) validateURL(parsed *url.URL) error {
 	// Only allow http and https
 	if parsed.Scheme != "http" && parsed.Scheme != "https" {
 		return ErrInvalidScheme
@@ -58,34 +158,188 @@ func (f *Fetcher) ValidateURL(rawURL string) error {
 		return ErrInvalidURL
 	}
 
-	return nil
+	if !f.rules.Allows(parsed.Hostname()) {
+		return fmt.Errorf("%w: %s", ErrDeniedHost, parsed.Hostname())
+	}
+
+	return f.policy.checkHost(parsed.Hostname())
+}
+
+// Injects reports whether requests to a URL carry injected credentials
+func (f *Fetcher) Injects(rawURL string) bool {
+	rule := f.Rule(rawURL)
+	return rule != nil && rule.Inject != nil
+}
+
+// Rule returns the host rule that applies to a URL, or nil
+func (f *Fetcher) Rule(rawURL string) *HostRule {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	return f.rules.Match(parsed.Hostname())
+}
+
+// Request describes an upstream request
+type Request struct {
+	Method string
+	URL    string
+	// Header is added to the default upstream headers
+	Header http.Header
+	Body   io.Reader
+	// Context cancels the upstream request along with the client's. Fetches
+	// shared with other requests or the cache leave it unset.
+	Context context.Context
 }
 
 // Fetch retrieves the content from the given URL
 func (f *Fetcher) Fetch(rawURL string) (*http.Response, error) {
-	if err := f.ValidateURL(rawURL); err != nil {
+	return f.Do(&Request{Method: http.MethodGet, URL: rawURL})
+}
+
+// Revalidate issues a conditional request using the validators of a cached
+// response. Upstream answers 304 Not Modified if the cached copy is current.
+func (f *Fetcher) Revalidate(rawURL, etag, lastModified string) (*http.Response, error) {
+	req := &Request{Method: http.MethodGet, URL: rawURL}
+	req.SetValidators(etag, lastModified)
+	return f.Do(req)
+}
+
+// SetValidators turns the request into a conditional request
+func (r *Request) SetValidators(etag, lastModified string) {
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+	r.Header.Del("If-None-Match")
+	r.Header.Del("If-Modified-Since")
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+}
+
+// Do issues an upstream request with any method
+func (f *Fetcher) Do(r *Request) (*http.Response, error) {
+	if err := f.ValidateURL(r.URL); err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	method := r.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	timeout, maxSize := f.timeout, f.maxSize
+	rule := f.Rule(r.URL)
+	if rule != nil {
+		if rule.Timeout > 0 {
+			timeout = time.Duration(rule.Timeout)
+		}
+		if rule.MaxSize > 0 {
+			maxSize = rule.MaxSize
+		}
+	}
+
+	// The timeout covers reading the body as well; closing it releases
+	// the context
+	parent := r.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(parent, timeout)
+
+	req, err := http.NewRequestWithContext(ctx, method, r.URL, r.Body)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Set a user agent to avoid being blocked by some servers
 	req.Header.Set("User-Agent", "ProxyHarold/1.0")
 	req.Header.Set("Accept", "*/*")
+	for key, values := range r.Header {
+		req.Header[key] = values
+	}
+	// Partial responses are only ever passed through and stay unencoded,
+	// so any client can use them
+	if f.keepEncoding && req.Header.Get("Range") == "" {
+		req.Header.Set("Accept-Encoding", AcceptEncoding)
+	}
+	if rule != nil {
+		rule.apply(req)
+	}
 
+	start := time.Now()
 	resp, err := f.client.Do(req)
+	if f.observer != nil {
+		pattern := UnmatchedHost
+		if rule != nil {
+			pattern = rule.Host
+		}
+		f.observer(req.URL.Hostname(), pattern, time.Since(start))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch URL: %w", err)
+		cancel()
+		return nil, fmt.Errorf("failed to fetch URL: %w", redact(err, r.URL))
 	}
 
 	// Check Content-Length if provided
-	if resp.ContentLength > f.maxSize {
+	if resp.ContentLength > maxSize {
 		resp.Body.Close()
-		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrResponseTooBig, resp.ContentLength, f.maxSize)
+		cancel()
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrResponseTooBig, resp.ContentLength, maxSize)
 	}
 
+	// Enforce the limit while reading too, the length may be missing or wrong
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: maxSize, limit: maxSize, cancel: cancel}
+
 	return resp, nil
 }
+
+// redact replaces the URL in a client error, which may carry injected
+// query parameters, with the URL as requested
+func redact(err error, rawURL string) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return &url.Error{Op: urlErr.Op, URL: rawURL, Err: urlErr.Err}
+	}
+	return err
+}
+
+// limitedBody fails reads with ErrResponseTooBig once more than limit bytes
+// have been read
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	limit     int64
+	cancel    context.CancelFunc
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrResponseTooBig, b.limit)
+	}
+
+	// Read one byte past the limit to detect oversized bodies
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) <= b.remaining {
+		b.remaining -= int64(n)
+		return n, err
+	}
+
+	n = int(b.remaining)
+	b.remaining = -1
+	return n, fmt.Errorf("%w: more than %d bytes", ErrResponseTooBig, b.limit)
+}
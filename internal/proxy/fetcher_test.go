@@ -1,15 +1,29 @@
 package proxy
 
 import (
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"strings"
 	"testing"
 	"time"
 )
 
+// newTestFetcher returns a fetcher that may reach httptest servers on loopback
+func newTestFetcher(timeout time.Duration, maxSize int64) *Fetcher {
+	policy, err := NewDestinationPolicy([]string{"127.0.0.0/8", "::1/128"}, nil)
+	if err != nil {
+		panic(err)
+	}
+	return NewFetcher(timeout, maxSize, WithDestinationPolicy(policy))
+}
+
 func TestFetcher_ValidatesURL(t *testing.T) {
-	fetcher := NewFetcher(10*time.Second, 10*1024*1024)
+	fetcher := newTestFetcher(10*time.Second, 10*1024*1024)
 
 	tests := []struct {
 		name    string
@@ -44,7 +58,7 @@ func TestFetcher_FetchesURL(t *testing.T) {
 	}))
 	defer server.Close()
 
-	fetcher := NewFetcher(10*time.Second, 10*1024*1024)
+	fetcher := newTestFetcher(10*time.Second, 10*1024*1024)
 
 	resp, err := fetcher.Fetch(server.URL)
 	if err != nil {
@@ -62,6 +76,57 @@ func TestFetcher_FetchesURL(t *testing.T) {
 	}
 }
 
+func TestFetcher_RevalidateSendsValidators(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != `"v1"` {
+			t.Errorf("missing If-None-Match, got %q", r.Header.Get("If-None-Match"))
+		}
+		if r.Header.Get("If-Modified-Since") != "Wed, 01 Jan 2025 00:00:00 GMT" {
+			t.Errorf("missing If-Modified-Since, got %q", r.Header.Get("If-Modified-Since"))
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	fetcher := newTestFetcher(10*time.Second, 10*1024*1024)
+
+	resp, err := fetcher.Revalidate(server.URL, `"v1"`, "Wed, 01 Jan 2025 00:00:00 GMT")
+	if err != nil {
+		t.Fatalf("Revalidate failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected 304, got %d", resp.StatusCode)
+	}
+}
+
+func TestFetcher_DoForwardsMethodAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + string(body) + " " + r.Header.Get("Content-Type")))
+	}))
+	defer server.Close()
+
+	fetcher := newTestFetcher(10*time.Second, 10*1024*1024)
+
+	resp, err := fetcher.Do(&Request{
+		Method: http.MethodPost,
+		URL:    server.URL,
+		Header: http.Header{"Content-Type": {"text/plain"}},
+		Body:   strings.NewReader("payload"),
+	})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "POST payload text/plain" {
+		t.Errorf("unexpected body: %s", string(body))
+	}
+}
+
 func TestFetcher_RespectsTimeout(t *testing.T) {
 	// Create a slow server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -71,7 +136,7 @@ func TestFetcher_RespectsTimeout(t *testing.T) {
 	defer server.Close()
 
 	// Use very short timeout
-	fetcher := NewFetcher(50*time.Millisecond, 10*1024*1024)
+	fetcher := newTestFetcher(50*time.Millisecond, 10*1024*1024)
 
 	_, err := fetcher.Fetch(server.URL)
 	if err == nil {
@@ -88,7 +153,7 @@ func TestFetcher_RejectsTooLargeResponse(t *testing.T) {
 	defer server.Close()
 
 	// Use small max size
-	fetcher := NewFetcher(10*time.Second, 1024) // 1KB max
+	fetcher := newTestFetcher(10*time.Second, 1024) // 1KB max
 
 	_, err := fetcher.Fetch(server.URL)
 	if err == nil {
@@ -96,6 +161,33 @@ func TestFetcher_RejectsTooLargeResponse(t *testing.T) {
 	}
 }
 
+func TestFetcher_LimitsChunkedBody(t *testing.T) {
+	// No Content-Length, so the limit can only be enforced while reading
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 10; i++ {
+			w.Write([]byte(strings.Repeat("x", 512)))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	fetcher := newTestFetcher(10*time.Second, 1024)
+
+	resp, err := fetcher.Fetch(server.URL)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if !errors.Is(err, ErrResponseTooBig) {
+		t.Errorf("expected ErrResponseTooBig, got %v", err)
+	}
+	if len(body) != 1024 {
+		t.Errorf("expected exactly 1024 bytes before failing, got %d", len(body))
+	}
+}
+
 func TestFetcher_PreservesContentType(t *testing.T) {
 	tests := []struct {
 		contentType string
@@ -114,7 +206,7 @@ func TestFetcher_PreservesContentType(t *testing.T) {
 			}))
 			defer server.Close()
 
-			fetcher := NewFetcher(10*time.Second, 10*1024*1024)
+			fetcher := newTestFetcher(10*time.Second, 10*1024*1024)
 			resp, err := fetcher.Fetch(server.URL)
 			if err != nil {
 				t.Fatalf("Fetch failed: %v", err)
@@ -127,3 +219,136 @@ func TestFetcher_PreservesContentType(t *testing.T) {
 		})
 	}
 }
+
+func TestFetcher_BlocksPrivateAddresses(t *testing.T) {
+	fetcher := NewFetcher(time.Second, 1024)
+
+	tests := []string{
+		"http://127.0.0.1/",
+		"http://10.0.0.1/",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://100.64.0.1/",
+		"http://224.0.0.1/",
+		"http://[::1]/",
+		"http://[fe80::1]/",
+		"http://[fd00::1]/",
+		"http://[::ffff:127.0.0.1]/",
+		"http://[2002:7f00:1::]/",
+		"http://[2002:a9fe:a9fe::1]/",
+	}
+
+	for _, rawURL := range tests {
+		t.Run(rawURL, func(t *testing.T) {
+			if err := fetcher.ValidateURL(rawURL); !errors.Is(err, ErrBlockedDestination) {
+				t.Errorf("ValidateURL(%q) error = %v, want ErrBlockedDestination", rawURL, err)
+			}
+		})
+	}
+}
+
+func TestFetcher_BlocksResolvedAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer server.Close()
+
+	fetcher := NewFetcher(time.Second, 1024)
+
+	// "localhost" passes URL validation and is only caught after resolution
+	_, port, _ := strings.Cut(strings.TrimPrefix(server.URL, "http://"), ":")
+	_, err := fetcher.Fetch("http://localhost:" + port)
+	if !errors.Is(err, ErrBlockedDestination) {
+		t.Errorf("expected ErrBlockedDestination, got %v", err)
+	}
+}
+
+func TestFetcher_BlocksRedirectToPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer server.Close()
+
+	fetcher := newTestFetcher(time.Second, 1024)
+
+	_, err := fetcher.Fetch(server.URL)
+	if !errors.Is(err, ErrBlockedDestination) {
+		t.Errorf("expected ErrBlockedDestination, got %v", err)
+	}
+}
+
+func TestDestinationPolicy_AllowAndDenyLists(t *testing.T) {
+	policy, err := NewDestinationPolicy([]string{"10.1.0.0/16"}, []string{"10.1.2.0/24", "8.8.8.8"})
+	if err != nil {
+		t.Fatalf("failed to create policy: %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"10.1.1.1", false}, // explicitly allowed private range
+		{"10.1.2.3", true},  // deny wins over allow
+		{"10.2.0.1", true},  // still in built-in private range
+		{"8.8.8.8", true},   // explicitly denied public address
+		{"1.1.1.1", false},  // public
+		{"2606:4700::1", false},
+		{"2002:a01:101::1", false}, // 6to4 for the allowed 10.1.1.1
+		{"2002:a01:203::1", true},  // 6to4 for the denied 10.1.2.3
+		{"2002:808:808::1", true},  // 6to4 for the denied 8.8.8.8
+		{"2002:101:101::1", false}, // 6to4 for public 1.1.1.1
+		{"2002:c0a8:101::1", true}, // 6to4 for private 192.168.1.1
+	}
+
+	for _, tt := range tests {
+		err := policy.CheckIP(netip.MustParseAddr(tt.ip))
+		if blocked := errors.Is(err, ErrBlockedDestination); blocked != tt.blocked {
+			t.Errorf("CheckIP(%s) blocked = %v, want %v", tt.ip, blocked, tt.blocked)
+		}
+	}
+
+	if _, err := NewDestinationPolicy([]string{"not-a-cidr"}, nil); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
+
+func TestFetcher_KeepsUpstreamEncoding(t *testing.T) {
+	var encoded bytes.Buffer
+	gz := gzip.NewWriter(&encoded)
+	gz.Write([]byte("compressed body"))
+	gz.Close()
+
+	var acceptEncoding []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = append(acceptEncoding, r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encoded.Bytes())
+	}))
+	defer server.Close()
+
+	policy, _ := NewDestinationPolicy([]string{"127.0.0.0/8", "::1/128"}, nil)
+	fetcher := NewFetcher(10*time.Second, 10*1024*1024, WithDestinationPolicy(policy), WithUpstreamEncoding(true))
+
+	resp, err := fetcher.Do(&Request{Method: http.MethodGet, URL: server.URL})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.Header.Get("Content-Encoding") != "gzip" || !bytes.Equal(body, encoded.Bytes()) {
+		t.Errorf("expected the encoded body with its Content-Encoding, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	resp, err = fetcher.Do(&Request{Method: http.MethodGet, URL: server.URL, Header: http.Header{"Range": {"bytes=0-3"}}})
+	if err != nil {
+		t.Fatalf("Do failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if acceptEncoding[0] != AcceptEncoding {
+		t.Errorf("expected Accept-Encoding %q, got %q", AcceptEncoding, acceptEncoding[0])
+	}
+	if acceptEncoding[1] != "" {
+		t.Errorf("expected no Accept-Encoding for a range request, got %q", acceptEncoding[1])
+	}
+}
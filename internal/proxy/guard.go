@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+)
+
+// blockedPrefixes are destination ranges that are never reachable unless
+// explicitly allowed: private, loopback, link-local, multicast, CGNAT and
+// other special-purpose networks.
+var blockedPrefixes = mustParsePrefixes(
+	// IPv4
+	"0.0.0.0/8",          // "this" network
+	"10.0.0.0/8",         // private
+	"100.64.0.0/10",      // carrier-grade NAT
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local (cloud metadata)
+	"172.16.0.0/12",      // private
+	"192.0.0.0/24",       // IETF protocol assignments
+	"192.0.2.0/24",       // TEST-NET-1
+	"192.168.0.0/16",     // private
+	"198.18.0.0/15",      // benchmarking
+	"198.51.100.0/24",    // TEST-NET-2
+	"203.0.113.0/24",     // TEST-NET-3
+	"224.0.0.0/4",        // multicast
+	"240.0.0.0/4",        // reserved
+	"255.255.255.255/32", // broadcast
+
+	// IPv6
+	"::/128",        // unspecified
+	"::1/128",       // loopback
+	"64:ff9b::/96",  // NAT64
+	"100::/64",      // discard-only
+	"2001:db8::/32", // documentation
+	"fc00::/7",      // unique local
+	"fe80::/10",     // link-local
+	"ff00::/8",      // multicast
+)
+
+// sixToFour is the 6to4 range, whose addresses embed an IPv4 address that
+// a host with a 6to4 route relays to
+var sixToFour = netip.MustParsePrefix("2002::/16")
+
+// DestinationPolicy decides which IP addresses the fetcher may connect to.
+// Deny entries take precedence over allow entries, and allow entries take
+// precedence over the built-in blocked ranges.
+type DestinationPolicy struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// NewDestinationPolicy creates a policy from allow and deny CIDR lists
+func NewDestinationPolicy(allow, deny []string) (*DestinationPolicy, error) {
+	allowPrefixes, err := parsePrefixes(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyPrefixes, err := parsePrefixes(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DestinationPolicy{
+		allow: allowPrefixes,
+		deny:  denyPrefixes,
+	}, nil
+}
+
+// CheckIP returns ErrBlockedDestination if the address must not be contacted
+func (p *DestinationPolicy) CheckIP(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if sixToFour.Contains(addr) {
+		if err := p.CheckIP(embeddedIPv4(addr)); err != nil {
+			return fmt.Errorf("%w (via %s)", err, addr)
+		}
+	}
+
+	if containsAddr(p.deny, addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+	}
+	if containsAddr(p.allow, addr) {
+		return nil
+	}
+	if containsAddr(blockedPrefixes, addr) {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, addr)
+	}
+
+	return nil
+}
+
+// embeddedIPv4 returns the IPv4 address in bits 16-47 of a 6to4 address
+func embeddedIPv4(addr netip.Addr) netip.Addr {
+	b := addr.As16()
+	return netip.AddrFrom4([4]byte{b[2], b[3], b[4], b[5]})
+}
+
+// checkHost rejects hosts that are IP literals in a blocked range.
+// Hostnames are checked after resolution by the dialer.
+func (p *DestinationPolicy) checkHost(host string) error {
+	addr, err := netip.ParseAddr(strings.Trim(host, "[]"))
+	if err != nil {
+		return nil
+	}
+	return p.CheckIP(addr)
+}
+
+// control is used as net.Dialer.Control. It runs for every address the
+// dialer attempts, after DNS resolution and on every redirect hop, so a
+// hostname cannot be rebound to a blocked address between checks.
+func (p *DestinationPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, address)
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlockedDestination, address)
+	}
+
+	return p.CheckIP(addr)
+}
+
+func parsePrefixes(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			addr, err := netip.ParseAddr(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func mustParsePrefixes(cidrs ...string) []netip.Prefix {
+	prefixes, err := parsePrefixes(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return prefixes
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// DefaultRequestHeaders are forwarded upstream unless configured otherwise
+var DefaultRequestHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Authorization",
+	"Content-Type",
+	"If-Range",
+	"Range",
+}
+
+// DefaultResponseHeaders are passed back to the client unless configured otherwise
+var DefaultResponseHeaders = []string{
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Language",
+	"Content-Type",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Link",
+	"Retry-After",
+}
+
+// hopByHopHeaders only apply to a single connection and are never forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// managedHeaders are set by the proxy itself and never copied across
+var managedHeaders = []string{
+	"Accept-Encoding",
+	"Content-Length",
+	"Host",
+	"X-Api-Key",
+	"X-Cache",
+}
+
+// HeaderPolicy decides which headers cross the proxy in one direction.
+// Hop-by-hop headers are always stripped, and cookies only pass when
+// explicitly enabled.
+type HeaderPolicy struct {
+	allowAll     bool
+	allow        map[string]bool
+	deny         map[string]bool
+	allowCookies bool
+}
+
+// NewHeaderPolicy creates a policy. An allow entry of "*" allows every
+// header that is not denied.
+func NewHeaderPolicy(allow, deny []string, allowCookies bool) *HeaderPolicy {
+	p := &HeaderPolicy{
+		allow:        make(map[string]bool),
+		deny:         make(map[string]bool),
+		allowCookies: allowCookies,
+	}
+
+	for _, name := range allow {
+		if name == "*" {
+			p.allowAll = true
+			continue
+		}
+		p.allow[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	for _, list := range [][]string{deny, hopByHopHeaders, managedHeaders} {
+		for _, name := range list {
+			p.deny[textproto.CanonicalMIMEHeaderKey(name)] = true
+		}
+	}
+
+	return p
+}
+
+// DefaultRequestHeaderPolicy returns the policy for headers sent upstream
+func DefaultRequestHeaderPolicy() *HeaderPolicy {
+	return NewHeaderPolicy(DefaultRequestHeaders, nil, false)
+}
+
+// DefaultResponseHeaderPolicy returns the policy for headers sent to clients
+func DefaultResponseHeaderPolicy() *HeaderPolicy {
+	return NewHeaderPolicy(DefaultResponseHeaders, nil, false)
+}
+
+// Allows reports whether a header may cross the proxy
+func (p *HeaderPolicy) Allows(name string) bool {
+	name = textproto.CanonicalMIMEHeaderKey(name)
+
+	switch {
+	case p.deny[name]:
+		return false
+	case name == "Cookie" || name == "Set-Cookie":
+		return p.allowCookies
+	case strings.HasPrefix(name, "Access-Control-"):
+		// CORS is decided by the proxy, not by upstream or the client
+		return false
+	}
+
+	return p.allowAll || p.allow[name]
+}
+
+// Filter returns the headers from src that the policy allows
+func (p *HeaderPolicy) Filter(src http.Header) http.Header {
+	// Headers named in Connection are hop-by-hop for this message
+	connection := make(map[string]bool)
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			connection[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	dst := make(http.Header)
+	for name, values := range src {
+		if connection[name] || !p.Allows(name) {
+			continue
+		}
+		dst[name] = append([]string(nil), values...)
+	}
+	return dst
+}
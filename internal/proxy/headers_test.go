@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeaderPolicy_Filter(t *testing.T) {
+	src := http.Header{
+		"Accept":            {"application/json"},
+		"Authorization":     {"Bearer token"},
+		"Connection":        {"keep-alive, X-Conn-Specific"},
+		"X-Conn-Specific":   {"1"},
+		"Transfer-Encoding": {"chunked"},
+		"Cookie":            {"session=abc"},
+		"X-Custom":          {"value"},
+		"X-Denied":          {"value"},
+	}
+
+	tests := []struct {
+		name    string
+		policy  *HeaderPolicy
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "defaults",
+			policy:  DefaultRequestHeaderPolicy(),
+			want:    []string{"Accept", "Authorization"},
+			notWant: []string{"Connection", "X-Conn-Specific", "Transfer-Encoding", "Cookie", "X-Custom"},
+		},
+		{
+			name:    "wildcard with deny list",
+			policy:  NewHeaderPolicy([]string{"*"}, []string{"x-denied"}, false),
+			want:    []string{"Accept", "Authorization", "X-Custom"},
+			notWant: []string{"X-Denied", "Connection", "X-Conn-Specific", "Transfer-Encoding", "Cookie"},
+		},
+		{
+			name:    "cookies enabled",
+			policy:  NewHeaderPolicy([]string{"accept"}, nil, true),
+			want:    []string{"Accept", "Cookie"},
+			notWant: []string{"Authorization"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Filter(src)
+			for _, name := range tt.want {
+				if got.Get(name) == "" {
+					t.Errorf("expected %s to pass", name)
+				}
+			}
+			for _, name := range tt.notWant {
+				if got.Get(name) != "" {
+					t.Errorf("expected %s to be stripped", name)
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderPolicy_NeverPassesCORSOrManagedHeaders(t *testing.T) {
+	policy := NewHeaderPolicy([]string{"*"}, nil, false)
+
+	for _, name := range []string{"Access-Control-Allow-Origin", "Content-Length", "X-Cache", "Set-Cookie", "Keep-Alive"} {
+		if policy.Allows(name) {
+			t.Errorf("expected %s to be blocked", name)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrDeniedHost is returned for destinations the host rules do not allow
+var ErrDeniedHost = errors.New("destination host is not allowed")
+
+// Rule actions
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// HostRule applies to every destination whose host matches Host
+type HostRule struct {
+	// Host is an exact hostname, "*.example.com" for its subdomains, or
+	// "*" for every host
+	Host   string `json:"host"`
+	Action string `json:"action"`
+
+	// TTL replaces the cache lifetime advertised by upstream
+	TTL Duration `json:"ttl,omitempty"`
+	// MaxSize replaces the maximum response size
+	MaxSize int64 `json:"max_size,omitempty"`
+	// Headers are set on every upstream request to the host
+	Headers map[string]string `json:"headers,omitempty"`
+	// Timeout replaces the fetch timeout
+	Timeout Duration `json:"timeout,omitempty"`
+	// Inject adds secret credentials to upstream requests
+	Inject *Injection `json:"inject,omitempty"`
+	// KeyHeaders are request headers whose values become part of the
+	// cache key, for hosts that vary their responses on them
+	KeyHeaders []string `json:"key_headers,omitempty"`
+}
+
+// Injection holds credentials added to upstream requests. Values may
+// reference secrets as ${NAME}, resolved by ResolveSecrets.
+type Injection struct {
+	Headers map[string]string `json:"headers,omitempty"`
+	Query   map[string]string `json:"query,omitempty"`
+}
+
+// Duration is a time.Duration written as a string such as "90s" in JSON
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// HostRules selects the first rule matching a destination host. Hosts
+// without a matching rule are allowed or denied by the default policy.
+type HostRules struct {
+	rules        []HostRule
+	defaultAllow bool
+}
+
+// NewHostRules validates rules and creates a rule set
+func NewHostRules(rules []HostRule, defaultAllow bool) (*HostRules, error) {
+	for i := range rules {
+		rule := &rules[i]
+		rule.Host = strings.ToLower(strings.TrimSpace(rule.Host))
+		if rule.Host == "" {
+			return nil, fmt.Errorf("host rule %d: missing host", i+1)
+		}
+		if rule.Action != ActionAllow && rule.Action != ActionDeny {
+			return nil, fmt.Errorf("host rule %d (%s): action must be %q or %q", i+1, rule.Host, ActionAllow, ActionDeny)
+		}
+		if rule.TTL < 0 || rule.MaxSize < 0 || rule.Timeout < 0 {
+			return nil, fmt.Errorf("host rule %d (%s): limits must not be negative", i+1, rule.Host)
+		}
+		for j, name := range rule.KeyHeaders {
+			rule.KeyHeaders[j] = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		}
+	}
+
+	return &HostRules{
+		rules:        rules,
+		defaultAllow: defaultAllow,
+	}, nil
+}
+
+// LoadHostRules reads a JSON array of rules from a file
+func LoadHostRules(path string, defaultAllow bool) (*HostRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []HostRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("invalid host rules file: %w", err)
+	}
+	return NewHostRules(rules, defaultAllow)
+}
+
+// ResolveSecrets replaces ${NAME} references in injected credentials.
+// Unknown secrets are an error, so a typo cannot silently send an empty
+// credential upstream.
+func (r *HostRules) ResolveSecrets(lookup func(name string) (string, bool)) error {
+	for i := range r.rules {
+		rule := &r.rules[i]
+		if rule.Inject == nil {
+			continue
+		}
+		for _, values := range []map[string]string{rule.Inject.Headers, rule.Inject.Query} {
+			for name, value := range values {
+				resolved, err := expandSecrets(value, lookup)
+				if err != nil {
+					return fmt.Errorf("host rule %d (%s): %s: %w", i+1, rule.Host, name, err)
+				}
+				values[name] = resolved
+			}
+		}
+	}
+	return nil
+}
+
+// CheckTTL rejects rules whose ttl exceeds max, the cache's upper bound for
+// any entry, which would otherwise cut them short without notice
+func (r *HostRules) CheckTTL(max time.Duration) error {
+	for i, rule := range r.rules {
+		if max > 0 && time.Duration(rule.TTL) > max {
+			return fmt.Errorf("host rule %d (%s): ttl %s exceeds the cache limit of %s", i+1, rule.Host, time.Duration(rule.TTL), max)
+		}
+	}
+	return nil
+}
+
+// expandSecrets replaces every ${NAME} in value
+func expandSecrets(value string, lookup func(string) (string, bool)) (string, error) {
+	var missing []string
+	expanded := os.Expand(value, func(name string) string {
+		secret, ok := lookup(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return secret
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unknown secret %q", missing[0])
+	}
+	return expanded, nil
+}
+
+// Secrets maps secret names to values
+type Secrets map[string]string
+
+// LoadSecrets reads a JSON object of secret names and values. An empty
+// path yields no secrets.
+func LoadSecrets(path string) (Secrets, error) {
+	secrets := make(Secrets)
+	if path == "" {
+		return secrets, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("invalid secrets file: %w", err)
+	}
+	return secrets, nil
+}
+
+// Lookup returns a secret from the file, falling back to the environment
+func (s Secrets) Lookup(name string) (string, bool) {
+	if value, ok := s[name]; ok {
+		return value, true
+	}
+	return os.LookupEnv(name)
+}
+
+// Match returns the first rule for a host, or nil
+func (r *HostRules) Match(host string) *HostRule {
+	if r == nil {
+		return nil
+	}
+
+	host = strings.ToLower(host)
+	for i := range r.rules {
+		if MatchHost(r.rules[i].Host, host) {
+			return &r.rules[i]
+		}
+	}
+	return nil
+}
+
+// Allows reports whether a host may be contacted
+func (r *HostRules) Allows(host string) bool {
+	if r == nil {
+		return true
+	}
+	if rule := r.Match(host); rule != nil {
+		return rule.Action == ActionAllow
+	}
+	return r.defaultAllow
+}
+
+// apply sets the rule's headers and injected credentials on a request
+func (rule *HostRule) apply(req *http.Request) {
+	for name, value := range rule.Headers {
+		req.Header.Set(name, value)
+	}
+	if rule.Inject != nil {
+		rule.Inject.apply(req)
+	}
+}
+
+// remove strips the rule's headers and injected headers from a request,
+// before it follows a redirect to a host the rule does not apply to
+func (rule *HostRule) remove(req *http.Request) {
+	for name := range rule.Headers {
+		req.Header.Del(name)
+	}
+	if rule.Inject != nil {
+		rule.Inject.remove(req)
+	}
+}
+
+// apply adds the injected headers and query parameters to a request
+func (inj *Injection) apply(req *http.Request) {
+	for name, value := range inj.Headers {
+		req.Header.Set(name, value)
+	}
+	if len(inj.Query) == 0 {
+		return
+	}
+
+	// Replace client values but keep the rest of the query as it was
+	var params []string
+	if req.URL.RawQuery != "" {
+		for _, param := range strings.Split(req.URL.RawQuery, "&") {
+			name, _, _ := strings.Cut(param, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				if _, injected := inj.Query[unescaped]; injected {
+					continue
+				}
+			}
+			params = append(params, param)
+		}
+	}
+	names := make([]string, 0, len(inj.Query))
+	for name := range inj.Query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(inj.Query[name]))
+	}
+	req.URL.RawQuery = strings.Join(params, "&")
+}
+
+// remove strips injected headers from a request, before it follows a
+// redirect to a host the injection does not apply to
+func (inj *Injection) remove(req *http.Request) {
+	for name := range inj.Headers {
+		req.Header.Del(name)
+	}
+}
+
+// MatchHost matches a lowercase host against an exact name, a
+// "*.example.com" pattern, which matches subdomains but not example.com
+// itself, or "*"
+func MatchHost(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return pattern == host
+}
@@ -0,0 +1,402 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newRuleFetcher returns a loopback-capable fetcher with host rules
+func newRuleFetcher(t *testing.T, rules []HostRule, defaultAllow bool) *Fetcher {
+	t.Helper()
+
+	hostRules, err := NewHostRules(rules, defaultAllow)
+	if err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	policy, _ := NewDestinationPolicy([]string{"127.0.0.0/8"}, nil)
+	return NewFetcher(time.Second, 1024, WithDestinationPolicy(policy), WithHostRules(hostRules))
+}
+
+func TestHostRules_FirstMatchWins(t *testing.T) {
+	rules, err := NewHostRules([]HostRule{
+		{Host: "internal.example.com", Action: ActionDeny},
+		{Host: "*.example.com", Action: ActionAllow, TTL: Duration(time.Minute)},
+		{Host: "Partner.org", Action: ActionAllow},
+	}, false)
+	if err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+
+	tests := map[string]bool{
+		"internal.example.com": false,
+		"api.example.com":      true,
+		"example.com":          false, // no rule, default deny
+		"partner.org":          true,
+		"PARTNER.ORG":          true,
+		"other.net":            false,
+	}
+	for host, want := range tests {
+		if got := rules.Allows(host); got != want {
+			t.Errorf("Allows(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	if rule := rules.Match("api.example.com"); rule == nil || rule.TTL != Duration(time.Minute) {
+		t.Errorf("expected the wildcard rule, got %+v", rule)
+	}
+}
+
+func TestHostRules_RejectsInvalidRules(t *testing.T) {
+	for _, rule := range []HostRule{
+		{Action: ActionAllow},
+		{Host: "example.com", Action: "maybe"},
+		{Host: "example.com", Action: ActionAllow, MaxSize: -1},
+	} {
+		if _, err := NewHostRules([]HostRule{rule}, true); err == nil {
+			t.Errorf("expected %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestLoadHostRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	os.WriteFile(path, []byte(`[
+		{"host": "api.example.com", "action": "allow", "ttl": "10m", "timeout": "90s",
+		 "max_size": 2048, "headers": {"X-Partner": "harold"}},
+		{"host": "*", "action": "deny"}
+	]`), 0o600)
+
+	rules, err := LoadHostRules(path, true)
+	if err != nil {
+		t.Fatalf("failed to load rules: %v", err)
+	}
+
+	rule := rules.Match("api.example.com")
+	if rule == nil {
+		t.Fatal("expected a rule for api.example.com")
+	}
+	if time.Duration(rule.TTL) != 10*time.Minute || time.Duration(rule.Timeout) != 90*time.Second {
+		t.Errorf("unexpected durations: %+v", rule)
+	}
+	if rule.MaxSize != 2048 || rule.Headers["X-Partner"] != "harold" {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+	if rules.Allows("elsewhere.com") {
+		t.Error("expected the catch-all deny rule to apply")
+	}
+
+	os.WriteFile(path, []byte(`[{"host": "a.com", "action": "allow", "ttl": "soon"}]`), 0o600)
+	if _, err := LoadHostRules(path, true); err == nil {
+		t.Error("expected an invalid duration to be rejected")
+	}
+}
+
+func TestFetcher_DeniesHostsByRule(t *testing.T) {
+	fetcher := newRuleFetcher(t, []HostRule{{Host: "127.0.0.1", Action: ActionAllow}}, false)
+
+	if err := fetcher.ValidateURL("https://example.com/"); !errors.Is(err, ErrDeniedHost) {
+		t.Errorf("expected ErrDeniedHost for an unmatched host, got %v", err)
+	}
+	if err := fetcher.ValidateURL("http://127.0.0.1/"); err != nil {
+		t.Errorf("expected allowed host to validate, got %v", err)
+	}
+}
+
+func TestFetcher_DeniesRedirectToDeniedHost(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost/elsewhere", http.StatusFound)
+	}))
+	defer server.Close()
+
+	fetcher := newRuleFetcher(t, []HostRule{{Host: "localhost", Action: ActionDeny}}, true)
+
+	if _, err := fetcher.Fetch(server.URL); !errors.Is(err, ErrDeniedHost) {
+		t.Errorf("expected ErrDeniedHost, got %v", err)
+	}
+}
+
+func TestFetcher_AppliesRuleLimitsAndHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Partner") != "harold" {
+			t.Errorf("expected rule header, got %q", r.Header.Get("X-Partner"))
+		}
+		if r.URL.Path == "/slow" {
+			time.Sleep(1500 * time.Millisecond)
+		}
+		w.Write(make([]byte, 4096))
+	}))
+	defer server.Close()
+
+	// The default fetcher allows 1024 bytes and waits one second
+	fetcher := newRuleFetcher(t, []HostRule{{
+		Host:    "127.0.0.1",
+		Action:  ActionAllow,
+		MaxSize: 8192,
+		Timeout: Duration(3 * time.Second),
+		Headers: map[string]string{"x-partner": "harold"},
+	}}, true)
+
+	for _, path := range []string{"/", "/slow"} {
+		resp, err := fetcher.Do(&Request{
+			URL:    server.URL + path,
+			Header: http.Header{"X-Partner": {"client value"}},
+		})
+		if err != nil {
+			t.Fatalf("%s: fetch failed: %v", path, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || len(body) != 4096 {
+			t.Errorf("%s: expected 4096 bytes, got %d (%v)", path, len(body), err)
+		}
+	}
+}
+
+func TestFetcher_AppliesRuleHeadersPerRedirectHop(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Origin") != "" {
+			t.Error("origin rule header followed a redirect to another host")
+		}
+		if r.Header.Get("X-Target") != "t" || r.Header.Get("X-Target-Key") != "k" {
+			t.Errorf("expected the target rule's headers, got %v", r.Header)
+		}
+	}))
+	defer target.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(target.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer origin.Close()
+
+	fetcher := newRuleFetcher(t, []HostRule{
+		{Host: "127.0.0.1", Action: ActionAllow, Headers: map[string]string{"X-Origin": "o"}},
+		{
+			Host:    "localhost",
+			Action:  ActionAllow,
+			Headers: map[string]string{"X-Target": "t"},
+			Inject:  &Injection{Headers: map[string]string{"X-Target-Key": "k"}},
+		},
+	}, true)
+
+	resp, err := fetcher.Fetch(origin.URL)
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestFetcher_ObservesLatencyByRule(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	rules, _ := NewHostRules([]HostRule{{Host: "127.0.0.1", Action: ActionAllow}}, true)
+	policy, _ := NewDestinationPolicy([]string{"127.0.0.0/8"}, nil)
+	var hosts, patterns []string
+	fetcher := NewFetcher(time.Second, 1024, WithDestinationPolicy(policy), WithHostRules(rules),
+		WithLatencyObserver(func(host, rule string, _ time.Duration) {
+			hosts, patterns = append(hosts, host), append(patterns, rule)
+		}))
+
+	for _, target := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1)} {
+		resp, err := fetcher.Fetch(target)
+		if err != nil {
+			t.Fatalf("fetch failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+
+	if len(patterns) != 2 || patterns[0] != "127.0.0.1" || patterns[1] != UnmatchedHost {
+		t.Errorf("expected the rule host and %q, got %v", UnmatchedHost, patterns)
+	}
+	if len(hosts) != 2 || hosts[1] != "localhost" {
+		t.Errorf("expected the destination hosts, got %v", hosts)
+	}
+}
+
+func TestHostRules_CheckTTL(t *testing.T) {
+	rules, _ := NewHostRules([]HostRule{
+		{Host: "a.example.com", Action: ActionAllow, TTL: Duration(time.Hour)},
+		{Host: "b.example.com", Action: ActionAllow, TTL: Duration(2 * time.Hour)},
+	}, true)
+
+	if err := rules.CheckTTL(2 * time.Hour); err != nil {
+		t.Errorf("expected ttls within the limit to pass, got %v", err)
+	}
+	if err := rules.CheckTTL(time.Hour); err == nil || !strings.Contains(err.Error(), "b.example.com") {
+		t.Errorf("expected the second rule to be rejected, got %v", err)
+	}
+}
+
+func TestHostRules_ResolveSecrets(t *testing.T) {
+	t.Setenv("PARTNER_KEY", "from-env")
+
+	rules, _ := NewHostRules([]HostRule{{
+		Host:   "api.example.com",
+		Action: ActionAllow,
+		Inject: &Injection{
+			Headers: map[string]string{"Authorization": "Bearer ${PARTNER_TOKEN}"},
+			Query:   map[string]string{"api_key": "${PARTNER_KEY}"},
+		},
+	}}, true)
+
+	secrets := Secrets{"PARTNER_TOKEN": "from-file"}
+	if err := rules.ResolveSecrets(secrets.Lookup); err != nil {
+		t.Fatalf("failed to resolve secrets: %v", err)
+	}
+
+	inject := rules.Match("api.example.com").Inject
+	if got := inject.Headers["Authorization"]; got != "Bearer from-file" {
+		t.Errorf("expected secret from file, got %q", got)
+	}
+	if got := inject.Query["api_key"]; got != "from-env" {
+		t.Errorf("expected secret from environment, got %q", got)
+	}
+
+	missing, _ := NewHostRules([]HostRule{{
+		Host:   "api.example.com",
+		Action: ActionAllow,
+		Inject: &Injection{Headers: map[string]string{"X-Key": "${NOT_DEFINED_ANYWHERE}"}},
+	}}, true)
+	if err := missing.ResolveSecrets(Secrets{}.Lookup); err == nil {
+		t.Error("expected an unknown secret to be an error")
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	os.WriteFile(path, []byte(`{"PARTNER_TOKEN": "s3cret"}`), 0o600)
+
+	secrets, err := LoadSecrets(path)
+	if err != nil {
+		t.Fatalf("failed to load secrets: %v", err)
+	}
+	if value, ok := secrets.Lookup("PARTNER_TOKEN"); !ok || value != "s3cret" {
+		t.Errorf("unexpected secret %q", value)
+	}
+
+	if secrets, err := LoadSecrets(""); err != nil || len(secrets) != 0 {
+		t.Errorf("expected no secrets without a file, got %v, %v", secrets, err)
+	}
+}
+
+func TestFetcher_InjectsCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "Bearer s3cret" {
+			t.Errorf("expected injected Authorization, got %q", got)
+		}
+		if got := r.URL.RawQuery; got != "b=2&a=1&api_key=k3y" {
+			t.Errorf("expected client query kept in order with the key appended, got %q", got)
+		}
+	}))
+	defer server.Close()
+
+	fetcher := newRuleFetcher(t, []HostRule{{
+		Host:   "127.0.0.1",
+		Action: ActionAllow,
+		Inject: &Injection{
+			Headers: map[string]string{"Authorization": "Bearer s3cret"},
+			Query:   map[string]string{"api_key": "k3y"},
+		},
+	}}, true)
+
+	if !fetcher.Injects(server.URL) {
+		t.Error("expected Injects to report the rule")
+	}
+
+	// Client attempts to set the credentials are overridden
+	resp, err := fetcher.Do(&Request{
+		URL:    server.URL + "/?b=2&api_key=client&a=1",
+		Header: http.Header{"Authorization": {"Bearer client"}},
+	})
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestFetcher_DoesNotLeakInjectedCredentials(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "" {
+			t.Error("injected header followed a redirect to another host")
+		}
+	}))
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// localhost is a different host from 127.0.0.1
+		http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer server.Close()
+
+	fetcher := newRuleFetcher(t, []HostRule{{
+		Host:   "127.0.0.1",
+		Action: ActionAllow,
+		Inject: &Injection{
+			Headers: map[string]string{"X-Api-Key": "s3cret"},
+			Query:   map[string]string{"api_key": "s3cret"},
+		},
+	}}, true)
+
+	resp, err := fetcher.Fetch(server.URL)
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	resp.Body.Close()
+
+	// Errors report the URL as requested, without injected parameters
+	server.Close()
+	_, err = fetcher.Fetch(server.URL + "/gone")
+	if err == nil {
+		t.Fatal("expected a fetch error")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error leaks the injected secret: %v", err)
+	}
+}
+
+func TestFetcher_DoesNotLeakInjectedCredentialsAcrossRedirects(t *testing.T) {
+	var leaked []string
+	final := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Secret") != "" {
+			leaked = append(leaked, "final")
+		}
+	}))
+	defer final.Close()
+
+	// localhost is a host without a rule
+	middle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Secret") != "" {
+			leaked = append(leaked, "middle")
+		}
+		http.Redirect(w, r, strings.Replace(final.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer middle.Close()
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, strings.Replace(middle.URL, "127.0.0.1", "localhost", 1)+"/next", http.StatusFound)
+	}))
+	defer origin.Close()
+
+	fetcher := newRuleFetcher(t, []HostRule{{
+		Host:   "127.0.0.1",
+		Action: ActionAllow,
+		Inject: &Injection{Headers: map[string]string{"X-Secret": "s3cret"}},
+	}}, true)
+
+	resp, err := fetcher.Fetch(origin.URL)
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(leaked) > 0 {
+		t.Errorf("injected header reached %v", leaked)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/time/rate"
@@ -15,17 +16,52 @@ type IPRateLimiter struct {
 	mu       sync.RWMutex
 	rate     rate.Limit
 	burst    int
+	identify IdentityFunc
+	only     bool
 	done     chan struct{}
+	rejected atomic.Int64
+}
+
+// Identity gives a request its own limit instead of its IP's, for example
+// an API key. A zero Rate uses the limiter's default rate and burst.
+type Identity struct {
+	Key   string
+	Rate  float64
+	Burst int
+}
+
+// IdentityFunc returns the identity of a request, or false to limit by IP
+type IdentityFunc func(r *http.Request) (Identity, bool)
+
+// Option configures an IPRateLimiter
+type Option func(*IPRateLimiter)
+
+// WithIdentity limits identified requests per identity rather than per IP
+func WithIdentity(fn IdentityFunc) Option {
+	return func(rl *IPRateLimiter) {
+		rl.identify = fn
+	}
+}
+
+// WithIdentifiedOnly lets requests without an identity through unlimited,
+// for a per-key limiter that runs behind a per-IP one
+func WithIdentifiedOnly() Option {
+	return func(rl *IPRateLimiter) {
+		rl.only = true
+	}
 }
 
 // NewIPRateLimiter creates a new rate limiter with specified rate (req/sec) and burst size
-func NewIPRateLimiter(r float64, burst int) *IPRateLimiter {
+func NewIPRateLimiter(r float64, burst int, opts ...Option) *IPRateLimiter {
 	rl := &IPRateLimiter{
 		limiters: make(map[string]*rate.Limiter),
 		rate:     rate.Limit(r),
 		burst:    burst,
 		done:     make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(rl)
+	}
 
 	// Start cleanup goroutine to remove stale limiters
 	go rl.cleanupLoop()
@@ -35,11 +71,23 @@ func NewIPRateLimiter(r float64, burst int) *IPRateLimiter {
 
 // getLimiter returns the rate limiter for the given IP, creating one if needed
 func (rl *IPRateLimiter) getLimiter(ip string) *rate.Limiter {
+	return rl.limiterFor(ip, rl.rate, rl.burst)
+}
+
+// limiterFor returns the rate limiter for a key, creating one if needed.
+// An existing limiter is adjusted if its limits changed.
+func (rl *IPRateLimiter) limiterFor(key string, r rate.Limit, burst int) *rate.Limiter {
 	rl.mu.RLock()
-	limiter, exists := rl.limiters[ip]
+	limiter, exists := rl.limiters[key]
 	rl.mu.RUnlock()
 
 	if exists {
+		if limiter.Limit() != r {
+			limiter.SetLimit(r)
+		}
+		if limiter.Burst() != burst {
+			limiter.SetBurst(burst)
+		}
 		return limiter
 	}
 
@@ -47,20 +95,54 @@ func (rl *IPRateLimiter) getLimiter(ip string) *rate.Limiter {
 	defer rl.mu.Unlock()
 
 	// Double-check after acquiring write lock
-	if limiter, exists = rl.limiters[ip]; exists {
+	if limiter, exists = rl.limiters[key]; exists {
 		return limiter
 	}
 
-	limiter = rate.NewLimiter(rl.rate, rl.burst)
-	rl.limiters[ip] = limiter
+	limiter = rate.NewLimiter(r, burst)
+	rl.limiters[key] = limiter
 	return limiter
 }
 
+// requestLimiter returns the limiter for a request's identity or IP, or nil
+// if the request is not limited
+func (rl *IPRateLimiter) requestLimiter(r *http.Request) *rate.Limiter {
+	if rl.identify != nil {
+		if id, ok := rl.identify(r); ok {
+			limit, burst := rl.rate, rl.burst
+			if id.Rate > 0 {
+				limit, burst = rate.Limit(id.Rate), id.Burst
+				if burst <= 0 {
+					burst = max(1, int(id.Rate))
+				}
+			}
+			// Prefixed so an identity can never share an IP's bucket
+			return rl.limiterFor("id:"+id.Key, limit, burst)
+		}
+	}
+	if rl.only {
+		return nil
+	}
+	return rl.getLimiter(extractIP(r))
+}
+
 // Allow checks if a request from the given IP should be allowed
 func (rl *IPRateLimiter) Allow(ip string) bool {
 	return rl.getLimiter(ip).Allow()
 }
 
+// Len returns the number of tracked IP addresses and identities
+func (rl *IPRateLimiter) Len() int {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	return len(rl.limiters)
+}
+
+// Rejected returns how many requests were rejected with 429
+func (rl *IPRateLimiter) Rejected() int64 {
+	return rl.rejected.Load()
+}
+
 // Cleanup stops the cleanup goroutine
 func (rl *IPRateLimiter) Cleanup() {
 	close(rl.done)
@@ -90,9 +172,14 @@ func (rl *IPRateLimiter) cleanupLoop() {
 // Middleware returns an HTTP middleware that enforces rate limiting
 func (rl *IPRateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := extractIP(r)
+		limiter := rl.requestLimiter(r)
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		if !rl.Allow(ip) {
+		if !limiter.Allow() {
+			rl.rejected.Add(1)
 			w.Header().Set("Content-Type", "application/json")
 			w.Header().Set("Retry-After", "1")
 			w.WriteHeader(http.StatusTooManyRequests)
@@ -101,7 +188,6 @@ func (rl *IPRateLimiter) Middleware(next http.Handler) http.Handler {
 		}
 
 		// Add rate limit headers
-		limiter := rl.getLimiter(ip)
 		w.Header().Set("X-RateLimit-Remaining", formatTokens(limiter.Tokens()))
 
 		next.ServeHTTP(w, r)
@@ -132,3 +132,92 @@ func TestRateLimiter_ConcurrentAccess(t *testing.T) {
 	wg.Wait()
 	// Just testing for race conditions - if we get here without panic, it's good
 }
+
+func TestRateLimiter_Stats(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 1)
+	defer limiter.Cleanup()
+
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, addr := range []string{"192.168.1.1:1", "192.168.1.1:2", "192.168.1.2:1"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = addr
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if got := limiter.Len(); got != 2 {
+		t.Errorf("expected 2 tracked IPs, got %d", got)
+	}
+	if got := limiter.Rejected(); got != 1 {
+		t.Errorf("expected 1 rejected request, got %d", got)
+	}
+}
+
+func TestRateLimiter_LimitsByIdentity(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 1, WithIdentity(func(r *http.Request) (Identity, bool) {
+		key := r.Header.Get("X-Key")
+		return Identity{Key: key, Rate: 1, Burst: 3}, key != ""
+	}))
+	defer limiter.Cleanup()
+
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Identified requests share the identity's burst across IPs
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1." + string(rune('1'+i)) + ":1"
+		req.Header.Set("X-Key", "alpha")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("request %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+
+	// Anonymous requests still use the per-IP limit
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.168.1.1:1"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected anonymous request to be allowed, got %d", rec.Code)
+	}
+}
+
+func TestRateLimiter_IdentifiedOnly(t *testing.T) {
+	limiter := NewIPRateLimiter(1, 1, WithIdentifiedOnly(), WithIdentity(func(r *http.Request) (Identity, bool) {
+		key := r.Header.Get("X-Key")
+		return Identity{Key: key}, key != ""
+	}))
+	defer limiter.Cleanup()
+
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// Anonymous requests are left to the per-IP limiter in front
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("anonymous request %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Key", "alpha")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("keyed request %d: expected %d, got %d", i, want, rec.Code)
+		}
+	}
+	if got := limiter.Len(); got != 1 {
+		t.Errorf("expected only the key to be tracked, got %d", got)
+	}
+}
@@ -0,0 +1,151 @@
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/harold/proxy-harold/internal/httperror"
+)
+
+// Query parameters of a signed proxy URL
+const (
+	ExpiresParam   = "expires"
+	SignatureParam = "sig"
+)
+
+// minSecretLength keeps secrets long enough to resist guessing
+const minSecretLength = 16
+
+var (
+	ErrNoSecrets        = errors.New("at least one signing secret is required")
+	ErrShortSecret      = errors.New("signing secrets must be at least 16 bytes")
+	ErrInvalidSignature = errors.New("invalid URL signature")
+	ErrExpired          = errors.New("signed URL has expired")
+)
+
+// Signer creates and verifies expiring proxy URLs signed with HMAC-SHA256
+// over the target URL and expiry. The first secret signs; every secret
+// verifies, so a new secret can be rolled out before the old one is retired.
+type Signer struct {
+	secrets [][]byte
+	now     func() time.Time
+}
+
+// NewSigner creates a signer from one or more secrets, newest first
+func NewSigner(secrets []string) (*Signer, error) {
+	if len(secrets) == 0 {
+		return nil, ErrNoSecrets
+	}
+
+	s := &Signer{now: time.Now}
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			return nil, ErrShortSecret
+		}
+		s.secrets = append(s.secrets, []byte(secret))
+	}
+	return s, nil
+}
+
+// Sign returns the signature for a target URL valid until expires
+func (s *Signer) Sign(target string, expires time.Time) string {
+	return signature(s.secrets[0], target, expires.Unix())
+}
+
+// SignURL returns a proxy URL for target under base, e.g.
+// "https://proxy.example.com/", valid until expires
+func (s *Signer) SignURL(base, target string, expires time.Time) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	u.RawQuery = "url=" + url.QueryEscape(target) +
+		"&" + ExpiresParam + "=" + strconv.FormatInt(expires.Unix(), 10) +
+		"&" + SignatureParam + "=" + s.Sign(target, expires)
+	return u.String(), nil
+}
+
+// Verify checks a signature against every secret, then the expiry
+func (s *Signer) Verify(target, expires, sig string) error {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || target == "" {
+		return ErrInvalidSignature
+	}
+
+	valid := false
+	for _, secret := range s.secrets {
+		if hmac.Equal([]byte(sig), []byte(signature(secret, target, unix))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	if !s.now().Before(time.Unix(unix, 0)) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// signature computes the base64url HMAC of the target and expiry
+func signature(secret []byte, target string, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(target))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Middleware verifies GET and HEAD requests carrying a signature and passes
+// them to next, rejecting invalid or expired ones with 403 and other
+// methods with 405. Requests without a
+// signature go to unsigned, or are rejected with 401 when it is nil. CORS
+// preflight requests always pass through.
+func (s *Signer) Middleware(next, unsigned http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		query := r.URL.Query()
+		if !query.Has(SignatureParam) {
+			if unsigned == nil {
+				httperror.Write(w, "signed URL required", http.StatusUnauthorized)
+				return
+			}
+			unsigned.ServeHTTP(w, r)
+			return
+		}
+
+		// Only the /?url= form is signed; a path-style target would not be
+		// the URL the signature covers
+		if r.URL.Path != "/" {
+			httperror.Write(w, "signed URLs must use the /?url= form", http.StatusBadRequest)
+			return
+		}
+		// A signature grants read access only; it does not cover a method
+		// or request body
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			httperror.Write(w, "signed URLs only allow GET and HEAD", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.Verify(query.Get("url"), query.Get(ExpiresParam), query.Get(SignatureParam)); err != nil {
+			httperror.Write(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
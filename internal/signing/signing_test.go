@@ -0,0 +1,112 @@
+package signing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	oldSecret = "old-secret-0123456789"
+	newSecret = "new-secret-0123456789"
+)
+
+func TestNewSigner_ValidatesSecrets(t *testing.T) {
+	if _, err := NewSigner(nil); err != ErrNoSecrets {
+		t.Errorf("expected ErrNoSecrets, got %v", err)
+	}
+	if _, err := NewSigner([]string{"short"}); err != ErrShortSecret {
+		t.Errorf("expected ErrShortSecret, got %v", err)
+	}
+}
+
+func TestSigner_Verify(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	signer, _ := NewSigner([]string{newSecret, oldSecret})
+	signer.now = func() time.Time { return now }
+
+	// URLs signed with the retiring secret still verify
+	retiring, _ := NewSigner([]string{oldSecret})
+	target := "https://api.example.com/data?x=1"
+	expires := now.Add(time.Minute)
+	expiresParam := "1700000060"
+
+	tests := []struct {
+		name    string
+		target  string
+		expires string
+		sig     string
+		want    error
+	}{
+		{"current secret", target, expiresParam, signer.Sign(target, expires), nil},
+		{"previous secret", target, expiresParam, retiring.Sign(target, expires), nil},
+		{"other target", "https://api.example.com/other", expiresParam, signer.Sign(target, expires), ErrInvalidSignature},
+		{"extended expiry", target, "1700000120", signer.Sign(target, expires), ErrInvalidSignature},
+		{"malformed expiry", target, "soon", signer.Sign(target, expires), ErrInvalidSignature},
+		{"expired", target, "1700000000", signer.Sign(target, now), ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := signer.Verify(tt.target, tt.expires, tt.sig); err != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// Secrets that are no longer configured stop verifying
+	rotated, _ := NewSigner([]string{newSecret})
+	rotated.now = signer.now
+	if err := rotated.Verify(target, expiresParam, retiring.Sign(target, expires)); err != ErrInvalidSignature {
+		t.Errorf("expected a removed secret to fail, got %v", err)
+	}
+}
+
+func TestSigner_Middleware(t *testing.T) {
+	signer, _ := NewSigner([]string{newSecret})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	unsigned := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	signed, err := signer.SignURL("http://proxy.local", "https://api.example.com/data", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	parsed, _ := url.Parse(signed)
+	if parsed.Path != "/" || parsed.Query().Get("url") != "https://api.example.com/data" {
+		t.Fatalf("unexpected signed URL %s", signed)
+	}
+	signedQuery := "/?" + parsed.RawQuery
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		unsigned http.Handler
+		want     int
+	}{
+		{"valid signature", "GET", signedQuery, unsigned, http.StatusOK},
+		{"valid signature for HEAD", "HEAD", signedQuery, unsigned, http.StatusOK},
+		{"signed POST", "POST", signedQuery, unsigned, http.StatusMethodNotAllowed},
+		{"signed DELETE", "DELETE", signedQuery, unsigned, http.StatusMethodNotAllowed},
+		{"tampered target", "GET", strings.Replace(signedQuery, "data", "admin", 1), unsigned, http.StatusForbidden},
+		{"path-style target", "GET", "/https://evil.example.com/" + signedQuery, unsigned, http.StatusBadRequest},
+		{"unsigned request", "GET", "/?url=https://api.example.com/data", unsigned, http.StatusTeapot},
+		{"unsigned rejected", "GET", "/?url=https://api.example.com/data", nil, http.StatusUnauthorized},
+		{"preflight", "OPTIONS", "/?url=https://api.example.com/data", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			signer.Middleware(next, tt.unsigned).ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, nil))
+			if rec.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rec.Code)
+			}
+		})
+	}
+}